@@ -18,6 +18,8 @@ import (
 
 var (
 	apiVersionDate = regexp.MustCompile("^\\d{4}-\\d{2}-\\d{2}")
+	// additional properties included in resource list responses
+	listExpand = "provisioningState,createdTime"
 )
 
 // AzureMetricDefinitionResponse represents metric definition response for a given resource from Azure.
@@ -40,9 +42,11 @@ type metricDefinitionResponse struct {
 		LocalizedValue string `json:"localizedValue"`
 		Value          string `json:"value"`
 	} `json:"name"`
-	PrimaryAggregationType string `json:"primaryAggregationType"`
-	ResourceID             string `json:"resourceId"`
-	Unit                   string `json:"unit"`
+	DisplayDescription        string   `json:"displayDescription"`
+	PrimaryAggregationType    string   `json:"primaryAggregationType"`
+	ResourceID                string   `json:"resourceId"`
+	SupportedAggregationTypes []string `json:"supportedAggregationTypes"`
+	Unit                      string   `json:"unit"`
 }
 
 // MetricNamespaceCollectionResponse represents metric namespace response for a given resource from Azure.
@@ -60,17 +64,42 @@ type metricNamespaceResponse struct {
 	} `json:"properties"`
 }
 
+// AzureMetricData represents the aggregated values of a metric over one time bucket.
+// Aggregations are nil when the bucket holds no data yet.
+type AzureMetricData struct {
+	TimeStamp string   `json:"timeStamp"`
+	Total     *float64 `json:"total"`
+	Average   *float64 `json:"average"`
+	Minimum   *float64 `json:"minimum"`
+	Maximum   *float64 `json:"maximum"`
+	// Count is the number of samples, only queried to weight the averages of rollups.
+	Count *float64 `json:"count"`
+}
+
+// value returns the value of an aggregation, and whether the bucket holds it.
+func (d AzureMetricData) value(aggregation string) (float64, bool) {
+	var v *float64
+	switch aggregation {
+	case "Total":
+		v = d.Total
+	case "Average":
+		v = d.Average
+	case "Minimum":
+		v = d.Minimum
+	case "Maximum":
+		v = d.Maximum
+	}
+	if v == nil {
+		return 0, false
+	}
+	return *v, true
+}
+
 // AzureMetricValueResponse represents a metric value response for a given metric definition.
 type AzureMetricValueResponse struct {
 	Value []struct {
 		Timeseries []struct {
-			Data []struct {
-				TimeStamp string  `json:"timeStamp"`
-				Total     float64 `json:"total"`
-				Average   float64 `json:"average"`
-				Minimum   float64 `json:"minimum"`
-				Maximum   float64 `json:"maximum"`
-			} `json:"data"`
+			Data []AzureMetricData `json:"data"`
 		} `json:"timeseries"`
 		ID   string `json:"id"`
 		Name struct {
@@ -86,32 +115,118 @@ type AzureMetricValueResponse struct {
 	} `json:"error"`
 }
 
-type AzureBatchMetricResponse struct {
-	Responses []struct {
-		HttpStatusCode int                      `json:"httpStatusCode"`
-		Content        AzureMetricValueResponse `json:"content"`
-	} `json:"responses"`
+// AzureMetricBaselineResponse represents the metric baselines of a resource.
+type AzureMetricBaselineResponse struct {
+	Value []struct {
+		Name       string `json:"name"`
+		Properties struct {
+			Baselines []struct {
+				Timestamps []string `json:"timestamps"`
+				Data       []struct {
+					Sensitivity    string    `json:"sensitivity"`
+					LowThresholds  []float64 `json:"lowThresholds"`
+					HighThresholds []float64 `json:"highThresholds"`
+				} `json:"data"`
+			} `json:"baselines"`
+		} `json:"properties"`
+	} `json:"value"`
+	APIError struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	} `json:"error"`
 }
 
-type AzureBatchLookupResponse struct {
-	Responses []struct {
-		HttpStatusCode int           `json:"httpStatusCode"`
-		Content        AzureResource `json:"content"`
-	} `json:"responses"`
+// AzureBatchResponse represents the responses to a batch of requests, in no particular order.
+type AzureBatchResponse struct {
+	Responses []batchResponse `json:"responses"`
+}
+
+type batchResponse struct {
+	Name           string          `json:"name"`
+	HttpStatusCode int             `json:"httpStatusCode"`
+	Content        json.RawMessage `json:"content"`
 }
 
 type AzureResourceListResponse struct {
-	Value []AzureResource `json:"value"`
+	Value    []AzureResource `json:"value"`
+	NextLink string          `json:"nextLink,omitempty"`
+}
+
+// azurePagedResponse represents a single page of an ARM list response.
+type azurePagedResponse struct {
+	Value    []json.RawMessage `json:"value"`
+	NextLink string            `json:"nextLink,omitempty"`
 }
 
 type AzureResource struct {
-	ID           string            `json:"id" pretty:"id"`
-	Name         string            `json:"name" pretty:"resource_name"`
-	Location     string            `json:"location" pretty:"azure_location"`
-	Type         string            `json:"type" pretty:"resource_type"`
-	Tags         map[string]string `json:"tags" pretty:"tags"`
-	ManagedBy    string            `json:"managedBy" pretty:"managed_by"`
-	Subscription string            `pretty:"azure_subscription"`
+	ID           string                 `json:"id" pretty:"id"`
+	Name         string                 `json:"name" pretty:"resource_name"`
+	Location     string                 `json:"location" pretty:"azure_location"`
+	Type         string                 `json:"type" pretty:"resource_type"`
+	Tags         map[string]string      `json:"tags" pretty:"tags"`
+	ManagedBy    string                 `json:"managedBy" pretty:"managed_by"`
+	Properties   map[string]interface{} `json:"properties" pretty:"properties"`
+	Subscription string                 `pretty:"azure_subscription"`
+
+	// Only returned by list operations expanded with $expand=provisioningState.
+	ProvisioningState string `json:"provisioningState" pretty:"-"`
+	// Only returned by list operations expanded with $expand=createdTime.
+	CreatedTime string `json:"createdTime" pretty:"-"`
+}
+
+// GetProvisioningState returns the provisioning state of the resource, or an empty string if unknown.
+func (r AzureResource) GetProvisioningState() string {
+	if state, ok := r.Properties["provisioningState"].(string); ok {
+		return state
+	}
+	return r.ProvisioningState
+}
+
+// AzureVMInstanceView represents the instance view of a virtual machine.
+type AzureVMInstanceView struct {
+	Statuses []struct {
+		Code          string `json:"code"`
+		DisplayStatus string `json:"displayStatus"`
+	} `json:"statuses"`
+}
+
+// GetPowerState returns the power state of the virtual machine (e.g. running or deallocated),
+// or an empty string if unknown.
+func (v AzureVMInstanceView) GetPowerState() string {
+	for _, status := range v.Statuses {
+		if strings.HasPrefix(status.Code, "PowerState/") {
+			return strings.ToLower(strings.TrimPrefix(status.Code, "PowerState/"))
+		}
+	}
+	return ""
+}
+
+// ResourceGraphResponse represents a page of rows returned by an Azure Resource Graph query.
+type ResourceGraphResponse struct {
+	Data []struct {
+		AzureResource
+		SubscriptionID string `json:"subscriptionId"`
+	} `json:"data"`
+	SkipToken string `json:"$skipToken"`
+}
+
+type resourceGraphRequest struct {
+	Subscriptions    []string `json:"subscriptions,omitempty"`
+	ManagementGroups []string `json:"managementGroups,omitempty"`
+	Query            string   `json:"query"`
+	Options          struct {
+		SkipToken    string `json:"$skipToken,omitempty"`
+		ResultFormat string `json:"resultFormat"`
+	} `json:"options"`
+}
+
+// ManagementGroupDescendantsResponse represents the subscriptions and management groups below a management group.
+type ManagementGroupDescendantsResponse struct {
+	Value []struct {
+		ID   string `json:"id"`
+		Type string `json:"type"`
+		Name string `json:"name"`
+	} `json:"value"`
 }
 
 type APIVersionResponse struct {
@@ -171,7 +286,7 @@ func (r *APIVersionResponse) extractAPIVersions() APIVersionMap {
 func (m *APIVersionMap) findBy(resourceType string) string {
 	var apiVersion string
 	for mType, mVersion := range *m {
-		if mType == resourceType {
+		if strings.EqualFold(mType, resourceType) {
 			apiVersion = mVersion
 			break
 		}
@@ -185,6 +300,7 @@ type AzureClient struct {
 	accessToken          string
 	accessTokenExpiresOn time.Time
 	APIVersions          APIVersionMap
+	definitions          *metricDefinitionCache
 }
 
 // NewAzureClient returns an Azure client to talk the Azure API
@@ -193,6 +309,7 @@ func NewAzureClient() *AzureClient {
 		client:               &http.Client{},
 		accessToken:          "",
 		accessTokenExpiresOn: time.Time{},
+		definitions:          newMetricDefinitionCache(),
 	}
 }
 
@@ -279,6 +396,43 @@ func (ac *AzureClient) getMetricDefinitions() (map[string]AzureMetricDefinitionR
 			definitions[defKey] = *def
 		}
 	}
+
+	for _, resourceGraph := range sc.C.ResourceGraphs {
+		resources, err := ac.listFromResourceGraph(resourceGraph)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get resources for resource graph query %s: %v", resourceGraph.Query, err)
+		}
+		for _, resource := range resources {
+			def, err := ac.getAzureMetricDefinitionResponse(resource.ID, resourceGraph.MetricNamespace)
+			if err != nil {
+				return nil, err
+			}
+			defKey := resource.ID
+			if len(resourceGraph.MetricNamespace) > 0 {
+				defKey = fmt.Sprintf("%s (Metric namespace: %s)", defKey, resourceGraph.MetricNamespace)
+			}
+			definitions[defKey] = *def
+		}
+	}
+
+	resourcesCache := make(map[string][]byte)
+	for _, resourceType := range sc.C.ResourceTypes {
+		resources, err := ac.filteredListByType(resourceType, resourcesCache)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get resources for resource types %s: %v", resourceType.ResourceTypes, err)
+		}
+		for _, resource := range resources {
+			def, err := ac.getAzureMetricDefinitionResponse(resource.ID, resourceType.MetricNamespace)
+			if err != nil {
+				return nil, err
+			}
+			defKey := resource.ID
+			if len(resourceType.MetricNamespace) > 0 {
+				defKey = fmt.Sprintf("%s (Metric namespace: %s)", defKey, resourceType.MetricNamespace)
+			}
+			definitions[defKey] = *def
+		}
+	}
 	return definitions, nil
 }
 
@@ -307,6 +461,35 @@ func (ac *AzureClient) getMetricNamespaces() (map[string]MetricNamespaceCollecti
 			namespaces[resource.ID] = *namespaceCollection
 		}
 	}
+
+	for _, resourceGraph := range sc.C.ResourceGraphs {
+		resources, err := ac.listFromResourceGraph(resourceGraph)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get resources for resource graph query %s: %v", resourceGraph.Query, err)
+		}
+		for _, resource := range resources {
+			namespaceCollection, err := ac.getMetricNamespaceCollectionResponse(resource.ID)
+			if err != nil {
+				return nil, err
+			}
+			namespaces[resource.ID] = *namespaceCollection
+		}
+	}
+
+	resourcesCache := make(map[string][]byte)
+	for _, resourceType := range sc.C.ResourceTypes {
+		resources, err := ac.filteredListByType(resourceType, resourcesCache)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to get resources for resource types %s: %v", resourceType.ResourceTypes, err)
+		}
+		for _, resource := range resources {
+			namespaceCollection, err := ac.getMetricNamespaceCollectionResponse(resource.ID)
+			if err != nil {
+				return nil, err
+			}
+			namespaces[resource.ID] = *namespaceCollection
+		}
+	}
 	return namespaces, nil
 }
 
@@ -314,28 +497,15 @@ func (ac *AzureClient) getMetricNamespaces() (map[string]MetricNamespaceCollecti
 func (ac *AzureClient) getAzureMetricDefinitionResponse(resource string, metricNamespace string) (*AzureMetricDefinitionResponse, error) {
 	apiVersion := "2018-01-01"
 
-	metricsResource := fmt.Sprintf("subscriptions/%s%s", sc.C.Credentials.SubscriptionID, resource)
-	metricsTarget := fmt.Sprintf("%s/%s/providers/microsoft.insights/metricDefinitions?api-version=%s", sc.C.ResourceManagerURL, metricsResource, apiVersion)
+	metricsResource := fullResourceID(resource)
+	metricsTarget := fmt.Sprintf("%s%s/providers/microsoft.insights/metricDefinitions?api-version=%s", sc.C.ResourceManagerURL, metricsResource, apiVersion)
 	if metricNamespace != "" {
 		metricsTarget = fmt.Sprintf("%s&metricnamespace=%s", metricsTarget, url.QueryEscape(metricNamespace))
 	}
 
-	req, err := http.NewRequest("GET", metricsTarget, nil)
-	if err != nil {
-		return nil, fmt.Errorf("Error creating HTTP request: %v", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+ac.accessToken)
-	resp, err := ac.client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Error: %v", err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	body, err := getAzureMonitorPagedResponse(metricsTarget)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading body of response: %v", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Error: %v", string(body))
+		return nil, err
 	}
 
 	def := &AzureMetricDefinitionResponse{}
@@ -350,24 +520,12 @@ func (ac *AzureClient) getAzureMetricDefinitionResponse(resource string, metricN
 func (ac *AzureClient) getMetricNamespaceCollectionResponse(resource string) (*MetricNamespaceCollectionResponse, error) {
 	apiVersion := "2017-12-01-preview"
 
-	nsResource := fmt.Sprintf("subscriptions/%s%s", sc.C.Credentials.SubscriptionID, resource)
-	nsTarget := fmt.Sprintf("%s/%s/providers/microsoft.insights/metricNamespaces?api-version=%s", sc.C.ResourceManagerURL, nsResource, apiVersion)
-	req, err := http.NewRequest("GET", nsTarget, nil)
-	if err != nil {
-		return nil, fmt.Errorf("Error creating HTTP request: %v", err)
-	}
-	req.Header.Set("Authorization", "Bearer "+ac.accessToken)
-	resp, err := ac.client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Error: %v", err)
-	}
-	defer resp.Body.Close()
-	body, err := ioutil.ReadAll(resp.Body)
+	nsResource := fullResourceID(resource)
+	nsTarget := fmt.Sprintf("%s%s/providers/microsoft.insights/metricNamespaces?api-version=%s", sc.C.ResourceManagerURL, nsResource, apiVersion)
+
+	body, err := getAzureMonitorPagedResponse(nsTarget)
 	if err != nil {
-		return nil, fmt.Errorf("Error reading body of response: %v", err)
-	}
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Error: %v", string(body))
+		return nil, err
 	}
 
 	namespaceCollection := &MetricNamespaceCollectionResponse{}
@@ -380,17 +538,60 @@ func (ac *AzureClient) getMetricNamespaceCollectionResponse(resource string) (*M
 
 // Returns resource list resolved and filtered from resource_groups configuration
 func (ac *AzureClient) filteredListFromResourceGroup(resourceGroup config.ResourceGroup) ([]AzureResource, error) {
-	resources, err := ac.listFromResourceGroup(resourceGroup.ResourceGroup, resourceGroup.ResourceTypes)
+	subscriptions, err := ac.subscriptionsFrom(resourceGroup.ManagementGroups)
 	if err != nil {
 		return nil, err
 	}
-	filteredResources := ac.filterResources(resources, resourceGroup)
+
+	var resources []AzureResource
+	for _, subscriptionID := range subscriptions {
+		groups := []string{resourceGroup.ResourceGroup}
+		if len(resourceGroup.ResourceGroup) == 0 {
+			groups, err = ac.listResourceGroups(subscriptionID, resourceGroup.ResourceGroupIncludeRe, resourceGroup.ResourceGroupExcludeRe)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		for _, group := range groups {
+			groupResources, err := ac.listFromResourceGroup(subscriptionID, group, resourceGroup.ResourceTypes)
+			if err != nil {
+				return nil, err
+			}
+			resources = append(resources, groupResources...)
+		}
+	}
+	filteredResources := ac.filterResources(resources, resourceGroup.ResourceNameIncludeRe, resourceGroup.ResourceNameExcludeRe)
 
 	return filteredResources, nil
 }
 
-// Returns resource list filtered by tag name and tag value
+// Returns resource list of the subscription filtered by types, locations, resource groups and names
+func (ac *AzureClient) filteredListByType(resourceType config.ResourceType, resourcesMap map[string][]byte) ([]AzureResource, error) {
+	resources, err := ac.listByTypes(resourceType.ResourceTypes, resourcesMap)
+	if err != nil {
+		return nil, err
+	}
+
+	var filteredResources []AzureResource
+	for _, resource := range resources {
+		if len(resourceType.Locations) > 0 && !hasLocation(resourceType.Locations, resource.Location) {
+			continue
+		}
+		if !matchesFilter(resourceGroupFrom(resource.ID), resourceType.ResourceGroupIncludeRe, resourceType.ResourceGroupExcludeRe) {
+			continue
+		}
+		filteredResources = append(filteredResources, resource)
+	}
+	return ac.filterResources(filteredResources, resourceType.ResourceNameIncludeRe, resourceType.ResourceNameExcludeRe), nil
+}
+
+// Returns resource list filtered by tag name and tag value, or by tag selector
 func (ac *AzureClient) filteredListByTag(resourceTag config.ResourceTag, resourcesMap map[string][]byte) ([]AzureResource, error) {
+	if !resourceTag.ResourceTagSelector.IsEmpty() {
+		return ac.listByTagSelector(resourceTag.ResourceTagSelector, resourceTag.ResourceTypes, resourcesMap)
+	}
+
 	resources, err := ac.listByTag(resourceTag.ResourceTagName, resourceTag.ResourceTagValue, resourceTag.ResourceTypes, resourcesMap)
 	if err != nil {
 		return nil, err
@@ -398,8 +599,78 @@ func (ac *AzureClient) filteredListByTag(resourceTag config.ResourceTag, resourc
 	return resources, nil
 }
 
-// Returns all resources for given resource group and types
-func (ac *AzureClient) listFromResourceGroup(resourceGroup string, resourceTypes []string) ([]AzureResource, error) {
+// Returns the subscriptions below the given management groups, or the configured subscription if there are none
+func (ac *AzureClient) subscriptionsFrom(managementGroups []string) ([]string, error) {
+	if len(managementGroups) == 0 {
+		return []string{sc.C.Credentials.SubscriptionID}, nil
+	}
+
+	apiVersion := "2020-05-01"
+	var subscriptions []string
+	seen := make(map[string]bool)
+	for _, managementGroup := range managementGroups {
+		descendantsEndpoint := fmt.Sprintf("%s/providers/Microsoft.Management/managementGroups/%s/descendants?api-version=%s",
+			strings.TrimSuffix(sc.C.ResourceManagerURL, "/"), url.PathEscape(managementGroup), apiVersion)
+
+		body, err := getAzureMonitorPagedResponse(descendantsEndpoint)
+		if err != nil {
+			return nil, err
+		}
+
+		var data ManagementGroupDescendantsResponse
+		err = json.Unmarshal(body, &data)
+		if err != nil {
+			return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+		}
+
+		for _, descendant := range data.Value {
+			if !strings.EqualFold(descendant.Type, "/subscriptions") || seen[strings.ToLower(descendant.Name)] {
+				continue
+			}
+			seen[strings.ToLower(descendant.Name)] = true
+			subscriptions = append(subscriptions, descendant.Name)
+		}
+	}
+	return subscriptions, nil
+}
+
+// Returns the names of the resource groups of a subscription matching the given regular expressions
+func (ac *AzureClient) listResourceGroups(subscriptionID string, includeRe []config.Regexp, excludeRe []config.Regexp) ([]string, error) {
+	resourceGroups, err := ac.listResourceGroupResources(subscriptionID)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, group := range resourceGroups {
+		if matchesFilter(group.Name, includeRe, excludeRe) {
+			groups = append(groups, group.Name)
+		}
+	}
+	return groups, nil
+}
+
+// Returns the resource groups of a subscription, along with their tags
+func (ac *AzureClient) listResourceGroupResources(subscriptionID string) ([]AzureResource, error) {
+	apiVersion := "2021-04-01"
+	resourceGroupsEndpoint := fmt.Sprintf("%s/subscriptions/%s/resourcegroups?api-version=%s",
+		strings.TrimSuffix(sc.C.ResourceManagerURL, "/"), subscriptionID, apiVersion)
+
+	body, err := getAzureMonitorPagedResponse(resourceGroupsEndpoint)
+	if err != nil {
+		return nil, err
+	}
+
+	var data AzureResourceListResponse
+	err = json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+	}
+	return data.Value, nil
+}
+
+// Returns all resources for given subscription, resource group and types
+func (ac *AzureClient) listFromResourceGroup(subscriptionID string, resourceGroup string, resourceTypes []string) ([]AzureResource, error) {
 	apiVersion := "2018-02-01"
 
 	var filterTypesElements []string
@@ -407,10 +678,10 @@ func (ac *AzureClient) listFromResourceGroup(resourceGroup string, resourceTypes
 		filterTypesElements = append(filterTypesElements, fmt.Sprintf("resourcetype eq '%s'", filterType))
 	}
 	filterTypes := url.QueryEscape(strings.Join(filterTypesElements, " or "))
-	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
-	resourcesEndpoint := fmt.Sprintf("%s/%s/resourceGroups/%s/resources?api-version=%s&$filter=%s", sc.C.ResourceManagerURL, subscription, resourceGroup, apiVersion, filterTypes)
+	subscription := fmt.Sprintf("subscriptions/%s", subscriptionID)
+	resourcesEndpoint := fmt.Sprintf("%s/%s/resourceGroups/%s/resources?api-version=%s&$filter=%s&$expand=%s", sc.C.ResourceManagerURL, subscription, resourceGroup, apiVersion, filterTypes, listExpand)
 
-	body, err := getAzureMonitorResponse(resourcesEndpoint)
+	body, err := getAzureMonitorPagedResponse(resourcesEndpoint)
 	if err != nil {
 		return nil, err
 	}
@@ -423,6 +694,36 @@ func (ac *AzureClient) listFromResourceGroup(resourceGroup string, resourceTypes
 	return data.extendResources(), nil
 }
 
+// Returns all resources of the subscription with the given types
+func (ac *AzureClient) listByTypes(resourceTypes []string, resourcesMap map[string][]byte) ([]AzureResource, error) {
+	apiVersion := "2018-05-01"
+
+	var filterTypesElements []string
+	for _, filterType := range resourceTypes {
+		filterTypesElements = append(filterTypesElements, fmt.Sprintf("resourceType eq '%s'", secureString(filterType)))
+	}
+	filterTypes := url.QueryEscape(strings.Join(filterTypesElements, " or "))
+	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
+	resourcesEndpoint := fmt.Sprintf("%s/%s/resources?api-version=%s&$filter=%s&$expand=%s", sc.C.ResourceManagerURL, subscription, apiVersion, filterTypes, listExpand)
+
+	body, ok := resourcesMap[resourcesEndpoint]
+	if !ok {
+		var err error
+		body, err = getAzureMonitorPagedResponse(resourcesEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		resourcesMap[resourcesEndpoint] = body
+	}
+
+	var data AzureResourceListResponse
+	err := json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+	}
+	return data.extendResources(), nil
+}
+
 // Returns all resource with the given couple tagname, tagvalue
 func (ac *AzureClient) listByTag(tagName string, tagValue string, types []string, resourcesMap map[string][]byte) ([]AzureResource, error) {
 	apiVersion := "2018-05-01"
@@ -430,12 +731,12 @@ func (ac *AzureClient) listByTag(tagName string, tagValue string, types []string
 	securedTagValue := secureString(tagValue)
 	filterTypes := url.QueryEscape(fmt.Sprintf("tagName eq '%s' and tagValue eq '%s'", securedTagName, securedTagValue))
 	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
-	resourcesEndpoint := fmt.Sprintf("%s/%s/resources?api-version=%s&$filter=%s", sc.C.ResourceManagerURL, subscription, apiVersion, filterTypes)
+	resourcesEndpoint := fmt.Sprintf("%s/%s/resources?api-version=%s&$filter=%s&$expand=%s", sc.C.ResourceManagerURL, subscription, apiVersion, filterTypes, listExpand)
 
 	body, ok := resourcesMap[resourcesEndpoint]
 	if !ok {
 		var err error
-		body, err = getAzureMonitorResponse(resourcesEndpoint)
+		body, err = getAzureMonitorPagedResponse(resourcesEndpoint)
 		if err != nil {
 			return nil, err
 		}
@@ -454,6 +755,94 @@ func (ac *AzureClient) listByTag(tagName string, tagValue string, types []string
 	return data.extendResources(), nil
 }
 
+// Returns all resources returned by the query of the given resource graph configuration
+func (ac *AzureClient) listFromResourceGraph(resourceGraph config.ResourceGraph) ([]AzureResource, error) {
+	apiVersion := "2021-03-01"
+
+	rmBaseURL := sc.C.ResourceManagerURL
+	if !strings.HasSuffix(sc.C.ResourceManagerURL, "/") {
+		rmBaseURL += "/"
+	}
+	resourcesEndpoint := fmt.Sprintf("%sproviders/Microsoft.ResourceGraph/resources?api-version=%s", rmBaseURL, apiVersion)
+
+	request := resourceGraphRequest{
+		Subscriptions:    resourceGraph.Subscriptions,
+		ManagementGroups: resourceGraph.ManagementGroups,
+		Query:            resourceGraph.Query,
+	}
+	if len(request.Subscriptions) == 0 && len(request.ManagementGroups) == 0 {
+		request.Subscriptions = []string{sc.C.Credentials.SubscriptionID}
+	}
+	request.Options.ResultFormat = "objectArray"
+
+	var resources []AzureResource
+	for {
+		body, err := postAzureMonitorResponse(resourcesEndpoint, request)
+		if err != nil {
+			return nil, err
+		}
+
+		var data ResourceGraphResponse
+		err = json.Unmarshal(body, &data)
+		if err != nil {
+			return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+		}
+
+		for _, row := range data.Data {
+			if row.ID == "" {
+				return nil, fmt.Errorf("Resource graph query must return the id column: %s", resourceGraph.Query)
+			}
+			resource := row.AzureResource
+			resource.ID = relativeResourceID(row.ID)
+			resource.Subscription = row.SubscriptionID
+			resources = append(resources, resource)
+		}
+
+		if data.SkipToken == "" {
+			break
+		}
+		request.Options.SkipToken = data.SkipToken
+	}
+	return resources, nil
+}
+
+// Returns all resources of the subscription whose tags match the given selector.
+// The subscription-wide listing is cached in resourcesMap and evaluated client-side.
+func (ac *AzureClient) listByTagSelector(selector config.TagSelector, types []string, resourcesMap map[string][]byte) ([]AzureResource, error) {
+	apiVersion := "2018-05-01"
+	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
+	resourcesEndpoint := fmt.Sprintf("%s/%s/resources?api-version=%s&$expand=%s", sc.C.ResourceManagerURL, subscription, apiVersion, listExpand)
+
+	body, ok := resourcesMap[resourcesEndpoint]
+	if !ok {
+		var err error
+		body, err = getAzureMonitorPagedResponse(resourcesEndpoint)
+		if err != nil {
+			return nil, err
+		}
+		resourcesMap[resourcesEndpoint] = body
+	}
+
+	var data AzureResourceListResponse
+	err := json.Unmarshal(body, &data)
+	if err != nil {
+		return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+	}
+
+	if len(types) > 0 {
+		data.Value = data.filterTypesInResourceList(types)
+	}
+
+	var resources []AzureResource
+	for _, resource := range data.Value {
+		if selector.Matches(resource.Tags) {
+			resources = append(resources, resource)
+		}
+	}
+	data.Value = resources
+	return data.extendResources(), nil
+}
+
 func (ac *AzureClient) listAPIVersions() error {
 	apiVersion := "2021-04-01"
 	var versionResponse APIVersionResponse
@@ -461,7 +850,7 @@ func (ac *AzureClient) listAPIVersions() error {
 	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
 	resourcesEndpoint := fmt.Sprintf("%s/%s/providers?api-version=%s", sc.C.ResourceManagerURL, subscription, apiVersion)
 
-	body, err := getAzureMonitorResponse(resourcesEndpoint)
+	body, err := getAzureMonitorPagedResponse(resourcesEndpoint)
 	if err != nil {
 		return err
 	}
@@ -517,49 +906,109 @@ func getAzureMonitorResponse(azureManagementEndpoint string) ([]byte, error) {
 	return body, err
 }
 
-func (ar *AzureResourceListResponse) extendResources() []AzureResource {
-	subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
-	var subscriptionPrefixLen = len(subscription) + 1
+func postAzureMonitorResponse(azureManagementEndpoint string, payload interface{}) ([]byte, error) {
+	payloadJSON, err := json.Marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequest("POST", azureManagementEndpoint, bytes.NewBuffer(payloadJSON))
+	if err != nil {
+		return nil, fmt.Errorf("Error creating HTTP request: %v", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+ac.accessToken)
+	resp, err := ac.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("Error: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("Error reading body of response: %v", err)
+	}
+
+	if resp.StatusCode != 200 {
+		return nil, fmt.Errorf("Unable to query API with status code: %d and with body: %s", resp.StatusCode, body)
+	}
+	return body, nil
+}
+
+// Returns the "value" entries of every page of an ARM list response, following nextLink
+// until the last page, merged into a single list response body.
+func getAzureMonitorPagedResponse(azureManagementEndpoint string) ([]byte, error) {
+	body, err := getAzureMonitorResponse(azureManagementEndpoint)
+	if err != nil {
+		return nil, err
+	}
+	return followNextLinks(body)
+}
 
+// Returns the "value" entries of the given first page of an ARM list response and of the
+// pages following it, merged into a single list response body.
+func followNextLinks(body []byte) ([]byte, error) {
+	values := []json.RawMessage{}
+	for {
+		var page azurePagedResponse
+		err := json.Unmarshal(body, &page)
+		if err != nil {
+			return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+		}
+		values = append(values, page.Value...)
+		if page.NextLink == "" {
+			break
+		}
+
+		body, err = getAzureMonitorResponse(page.NextLink)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(azurePagedResponse{Value: values})
+}
+
+func (ar *AzureResourceListResponse) extendResources() []AzureResource {
 	for i, val := range ar.Value {
-		ar.Value[i].ID = val.ID[subscriptionPrefixLen:]
-		ar.Value[i].Subscription = sc.C.Credentials.SubscriptionID
+		ar.Value[i].ID = relativeResourceID(val.ID)
+		ar.Value[i].Subscription = subscriptionFrom(val.ID)
 	}
 	return ar.Value
 }
 
 // Returns a filtered resource list based on a given resource list and regular expressions from the configuration
-func (ac *AzureClient) filterResources(resources []AzureResource, resourceGroup config.ResourceGroup) []AzureResource {
+func (ac *AzureClient) filterResources(resources []AzureResource, includeRe []config.Regexp, excludeRe []config.Regexp) []AzureResource {
 	filteredResources := []AzureResource{}
 
 	for _, resource := range resources {
-		if len(resourceGroup.ResourceNameIncludeRe) != 0 {
-			include := false
-			for _, rx := range resourceGroup.ResourceNameIncludeRe {
-				if rx.MatchString(resource.Name) {
-					include = true
-					break
-				}
-			}
-			if !include {
-				continue
-			}
+		if matchesFilter(resource.Name, includeRe, excludeRe) {
+			filteredResources = append(filteredResources, resource)
 		}
+	}
+	return filteredResources
+}
 
-		exclude := false
-		for _, rx := range resourceGroup.ResourceNameExcludeRe {
-			if rx.MatchString(resource.Name) {
-				exclude = true
+// Reports whether name matches one of the include regular expressions (if any) and none of the excludes.
+// Excludes take precedence over includes.
+func matchesFilter(name string, includeRe []config.Regexp, excludeRe []config.Regexp) bool {
+	if len(includeRe) != 0 {
+		include := false
+		for _, rx := range includeRe {
+			if rx.MatchString(name) {
+				include = true
 				break
 			}
 		}
+		if !include {
+			return false
+		}
+	}
 
-		if exclude {
-			continue
+	for _, rx := range excludeRe {
+		if rx.MatchString(name) {
+			return false
 		}
-		filteredResources = append(filteredResources, resource)
 	}
-	return filteredResources
+	return true
 }
 
 func (ac *AzureClient) refreshAccessToken() error {
@@ -580,6 +1029,7 @@ type batchBody struct {
 }
 
 type batchRequest struct {
+	Name        string `json:"name"`
 	RelativeURL string `json:"relativeUrl"`
 	Method      string `json:"httpMethod"`
 }
@@ -587,11 +1037,7 @@ type batchRequest struct {
 func resourceURLFrom(resource string, metricNamespace string, metricNames string, aggregations []string) string {
 	apiVersion := "2018-01-01"
 
-	path := fmt.Sprintf(
-		"/subscriptions/%s%s/providers/microsoft.insights/metrics",
-		sc.C.Credentials.SubscriptionID,
-		resource,
-	)
+	path := fmt.Sprintf("%s/providers/microsoft.insights/metrics", fullResourceID(resource))
 
 	endTime, startTime := GetTimes()
 
@@ -614,44 +1060,112 @@ func resourceURLFrom(resource string, metricNamespace string, metricNames string
 	return url.String()
 }
 
-func (ac *AzureClient) getBatchResponseBody(urls []string) ([]byte, error) {
+// baselineURLFrom builds the query of the metric baselines of a metric over the last hour, at its default interval.
+func baselineURLFrom(resource string, metricNamespace string, metricName string, aggregation string, sensitivity string) string {
+	apiVersion := "2019-03-01"
 
-	rmBaseURL := sc.C.ResourceManagerURL
-	if !strings.HasSuffix(sc.C.ResourceManagerURL, "/") {
-		rmBaseURL += "/"
-	}
+	path := fmt.Sprintf("%s/providers/microsoft.insights/metricBaselines", fullResourceID(resource))
 
-	apiURL := fmt.Sprintf("%sbatch?api-version=2017-03-01", rmBaseURL)
+	end := time.Now().UTC().Add(time.Minute * time.Duration(-3))
 
-	batch := batchBody{}
-	for _, u := range urls {
-		batch.Requests = append(batch.Requests, batchRequest{
-			RelativeURL: u,
-			Method:      "GET",
-		})
+	values := url.Values{}
+	values.Add("metricnames", metricName)
+	if metricNamespace != "" {
+		values.Add("metricnamespace", metricNamespace)
 	}
+	values.Add("aggregation", strings.ToLower(aggregation))
+	values.Add("sensitivities", sensitivity)
+	values.Add("resultType", "Data")
+	values.Add("timespan", fmt.Sprintf("%s/%s", end.Add(-time.Hour).Format(time.RFC3339), end.Format(time.RFC3339)))
+	values.Add("api-version", apiVersion)
 
-	batchJSON, err := json.Marshal(batch)
-	if err != nil {
-		return nil, err
+	url := url.URL{
+		Path:     path,
+		RawQuery: values.Encode(),
 	}
+	return url.String()
+}
 
-	req, err := http.NewRequest("POST", apiURL, bytes.NewBuffer(batchJSON))
-	if err != nil {
-		return nil, fmt.Errorf("Error creating HTTP request: %v", err)
+// Returns the batch response for each of the given relative URLs, keyed by the index of the URL.
+// Requests are named after that index so that responses are matched by name rather than position.
+// Requests missing from a batch response are re-queued up to batchRetries times; indexes still
+// missing after that are absent from the result.
+func (ac *AzureClient) getBatchResponses(urls []string) (map[int]batchResponse, error) {
+	responses := make(map[int]batchResponse)
+
+	pending := make([]int, len(urls))
+	for i := range urls {
+		pending[i] = i
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+ac.accessToken)
 
-	resp, err := ac.client.Do(req)
-	if err != nil {
-		return nil, fmt.Errorf("Error: %v", err)
+	for attempt := 0; attempt <= batchRetries && len(pending) > 0; attempt++ {
+		var missing []int
+
+		for i := 0; i < len(pending); i += batchSize {
+			j := i + batchSize
+
+			// don't forget to add remainder requests
+			if j > len(pending) {
+				j = len(pending)
+			}
+
+			var requests []batchRequest
+			expected := make(map[string]int)
+			for _, idx := range pending[i:j] {
+				name := strconv.Itoa(idx)
+				requests = append(requests, batchRequest{
+					Name:        name,
+					RelativeURL: urls[idx],
+					Method:      "GET",
+				})
+				expected[name] = idx
+			}
+
+			batchBody, err := ac.getBatchResponseBody(requests)
+			if err != nil {
+				return nil, err
+			}
+
+			var batchData AzureBatchResponse
+			err = json.Unmarshal(batchBody, &batchData)
+			if err != nil {
+				return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+			}
+
+			for _, resp := range batchData.Responses {
+				idx, ok := expected[resp.Name]
+				if !ok {
+					log.Printf("Ignoring unexpected batch response with name %q", resp.Name)
+					continue
+				}
+				responses[idx] = resp
+				delete(expected, resp.Name)
+			}
+
+			for _, idx := range pending[i:j] {
+				if _, ok := expected[strconv.Itoa(idx)]; ok {
+					missing = append(missing, idx)
+				}
+			}
+		}
+
+		if len(missing) > 0 && attempt < batchRetries {
+			log.Printf("%d requests missing from batch responses, re-queueing them", len(missing))
+		}
+		pending = missing
 	}
-	defer resp.Body.Close()
+	return responses, nil
+}
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+func (ac *AzureClient) getBatchResponseBody(requests []batchRequest) ([]byte, error) {
+
+	rmBaseURL := sc.C.ResourceManagerURL
+	if !strings.HasSuffix(sc.C.ResourceManagerURL, "/") {
+		rmBaseURL += "/"
 	}
-	return body, nil
+
+	apiURL := fmt.Sprintf("%sbatch?api-version=2017-03-01", rmBaseURL)
+
+	// A failed batch call, e.g. throttled or unauthorized, is an error rather than a batch of missing responses.
+	return postAzureMonitorResponse(apiURL, batchBody{Requests: requests})
 }
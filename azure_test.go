@@ -0,0 +1,419 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+const testSubscriptionID = "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6"
+
+// pagedFake serves the given pages of a list response on every path,
+// linking each page to the next one through nextLink.
+func pagedFake(t *testing.T, pages [][]interface{}) *httptest.Server {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page := 0
+		if p := r.URL.Query().Get("page"); p != "" {
+			fmt.Sscanf(p, "%d", &page)
+		}
+		if page >= len(pages) {
+			t.Errorf("unexpected request for page %d", page)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+
+		resp := map[string]interface{}{"value": pages[page]}
+		if page+1 < len(pages) {
+			resp["nextLink"] = fmt.Sprintf("%s%s?page=%d", srv.URL, r.URL.Path, page+1)
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	return srv
+}
+
+func setupFakeConfig(url string) {
+	sc.C = &config.Config{
+		ResourceManagerURL: url,
+		Credentials: config.Credentials{
+			SubscriptionID: testSubscriptionID,
+		},
+	}
+}
+
+func fakeResource(rg string, name string) map[string]interface{} {
+	return map[string]interface{}{
+		"id":   fmt.Sprintf("/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Compute/virtualMachines/%s", testSubscriptionID, rg, name),
+		"name": name,
+		"type": "Microsoft.Compute/virtualMachines",
+	}
+}
+
+func TestListFromResourceGroupPaged(t *testing.T) {
+	srv := pagedFake(t, [][]interface{}{
+		{fakeResource("rg", "vm-01"), fakeResource("rg", "vm-02")},
+		{fakeResource("rg", "vm-03")},
+		{},
+		{fakeResource("rg", "vm-04")},
+	})
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	resources, err := ac.listFromResourceGroup(testSubscriptionID, "rg", []string{"Microsoft.Compute/virtualMachines"})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, r := range resources {
+		got = append(got, r.ID)
+	}
+	want := []string{
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-01",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-02",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-03",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-04",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't list resources from every page\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestListByTagPaged(t *testing.T) {
+	srv := pagedFake(t, [][]interface{}{
+		{fakeResource("rg-a", "vm-01")},
+		{fakeResource("rg-b", "vm-02")},
+	})
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	resources, err := ac.listByTag("monitoring", "enabled", nil, map[string][]byte{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(resources) != 2 {
+		t.Errorf("doesn't list resources from every page\ngot: %d resources\nwant: 2", len(resources))
+	}
+}
+
+func TestGetAzureMetricDefinitionResponsePaged(t *testing.T) {
+	definition := func(name string) map[string]interface{} {
+		return map[string]interface{}{"name": map[string]string{"value": name}}
+	}
+	srv := pagedFake(t, [][]interface{}{
+		{definition("Percentage CPU")},
+		{definition("Network In Total"), definition("Network Out Total")},
+	})
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	def, err := ac.getAzureMetricDefinitionResponse("/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-01", "")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, d := range def.MetricDefinitionResponses {
+		got = append(got, d.Name.Value)
+	}
+	want := []string{"Percentage CPU", "Network In Total", "Network Out Total"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't list metric definitions from every page\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestGetMetricNamespaceCollectionResponsePaged(t *testing.T) {
+	namespace := func(name string) map[string]interface{} {
+		return map[string]interface{}{"properties": map[string]string{"metricNamespaceName": name}}
+	}
+	srv := pagedFake(t, [][]interface{}{
+		{namespace("Microsoft.Compute/virtualMachines")},
+		{namespace("Azure.VM.Windows.GuestMetrics")},
+	})
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	namespaces, err := ac.getMetricNamespaceCollectionResponse("/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-01")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, ns := range namespaces.MetricNamespaceCollection {
+		got = append(got, ns.Properties.MetricNamespaceName)
+	}
+	want := []string{"Microsoft.Compute/virtualMachines", "Azure.VM.Windows.GuestMetrics"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't list metric namespaces from every page\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestListAPIVersionsPaged(t *testing.T) {
+	provider := func(namespace string, resourceType string, version string) map[string]interface{} {
+		return map[string]interface{}{
+			"namespace":     namespace,
+			"resourceTypes": []map[string]interface{}{{"resourceType": resourceType, "apiVersions": []string{version}}},
+		}
+	}
+	srv := pagedFake(t, [][]interface{}{
+		{provider("Microsoft.Compute", "virtualMachines", "2021-03-01")},
+		{provider("Microsoft.ServiceBus", "namespaces", "2017-04-01")},
+	})
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	if err := ac.listAPIVersions(); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	for resourceType, want := range map[string]string{
+		"Microsoft.Compute/virtualMachines": "2021-03-01",
+		"Microsoft.ServiceBus/namespaces":   "2017-04-01",
+	} {
+		if got := ac.APIVersions.findBy(resourceType); got != want {
+			t.Errorf("doesn't list API versions from every page for %s\ngot: %v\nwant: %v", resourceType, got, want)
+		}
+	}
+}
+
+func TestGetBatchResponses(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		var batch batchBody
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+
+		// Answer in reverse order, drop the request for "never" every time and
+		// the request for "later" the first time it is seen.
+		var responses []map[string]interface{}
+		for i := len(batch.Requests) - 1; i >= 0; i-- {
+			req := batch.Requests[i]
+			if req.RelativeURL == "never" || (req.RelativeURL == "later" && calls == 1) {
+				continue
+			}
+			responses = append(responses, map[string]interface{}{
+				"name":           req.Name,
+				"httpStatusCode": 200,
+				"content":        map[string]string{"url": req.RelativeURL},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	urls := []string{"first", "later", "never", "last"}
+	responses, err := ac.getBatchResponses(urls)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	for i, u := range urls {
+		resp, ok := responses[i]
+		if u == "never" {
+			if ok {
+				t.Errorf("got response for request %q that was never answered", u)
+			}
+			continue
+		}
+		if !ok {
+			t.Errorf("missing response for request %q", u)
+			continue
+		}
+
+		var content map[string]string
+		json.Unmarshal(resp.Content, &content)
+		if content["url"] != u {
+			t.Errorf("response for request %q matched to %q", content["url"], u)
+		}
+	}
+	if calls != 1+batchRetries {
+		t.Errorf("doesn't re-queue missing requests\ngot: %d calls\nwant: %d", calls, 1+batchRetries)
+	}
+}
+
+func TestGetBatchResponsesStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+		w.Write([]byte(`{"error": {"code": "TooManyRequests"}}`))
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	_, err := ac.getBatchResponses([]string{"first"})
+	if err == nil || !strings.Contains(err.Error(), "TooManyRequests") {
+		t.Errorf("doesn't report the failed batch call\ngot: %v", err)
+	}
+}
+
+func TestListFromResourceGraph(t *testing.T) {
+	var requests []resourceGraphRequest
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req resourceGraphRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		requests = append(requests, req)
+
+		resp := map[string]interface{}{}
+		if req.Options.SkipToken == "" {
+			row := fakeResource("rg", "db-01")
+			row["subscriptionId"] = testSubscriptionID
+			resp["data"] = []interface{}{row}
+			resp["$skipToken"] = "next"
+		} else {
+			row := map[string]interface{}{
+				"id":             "/subscriptions/other/resourceGroups/rg/providers/Microsoft.Sql/servers/sql/databases/db-02",
+				"subscriptionId": "other",
+				"properties":     map[string]interface{}{"provisioningState": "Succeeded"},
+			}
+			resp["data"] = []interface{}{row}
+		}
+		json.NewEncoder(w).Encode(resp)
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	resources, err := ac.listFromResourceGraph(config.ResourceGraph{
+		Query:            "Resources | where type =~ 'microsoft.sql/servers/databases'",
+		ManagementGroups: []string{"platform"},
+	})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	if len(requests) != 2 {
+		t.Fatalf("doesn't follow $skipToken\ngot: %d requests\nwant: 2", len(requests))
+	}
+	if len(requests[0].Subscriptions) != 0 || !reflect.DeepEqual(requests[0].ManagementGroups, []string{"platform"}) {
+		t.Errorf("doesn't query the configured scopes\ngot: %v", requests[0])
+	}
+
+	var got []string
+	for _, r := range resources {
+		got = append(got, r.Subscription+" "+r.ID)
+	}
+	want := []string{
+		testSubscriptionID + " /resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/db-01",
+		"other /subscriptions/other/resourceGroups/rg/providers/Microsoft.Sql/servers/sql/databases/db-02",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't list resource graph results\ngot: %v\nwant: %v", got, want)
+	}
+	if resources[1].Properties["provisioningState"] != "Succeeded" {
+		t.Errorf("doesn't keep resource properties\ngot: %v", resources[1].Properties)
+	}
+}
+
+func TestFilteredListByType(t *testing.T) {
+	resource := func(rg string, name string, location string) map[string]interface{} {
+		r := fakeResource(rg, name)
+		r["location"] = location
+		return r
+	}
+	srv := pagedFake(t, [][]interface{}{
+		{resource("customer-a", "vm-01", "westeurope"), resource("customer-b", "vm-02", "eastus")},
+		{resource("customer-c", "vm-03", "westeurope"), resource("shared", "vm-04", "westeurope")},
+		{resource("customer-d", "test-vm-05", "westeurope")},
+	})
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	var selector config.ResourceType
+	err := yaml.Unmarshal([]byte(`
+resource_types: ["Microsoft.Compute/virtualMachines"]
+locations: ["West Europe"]
+resource_group_include_re: ["customer-.*"]
+resource_name_exclude_re: ["test-.*"]
+metrics:
+  - name: "Percentage CPU"
+`), &selector)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resources, err := ac.filteredListByType(selector, map[string][]byte{})
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, r := range resources {
+		got = append(got, r.Name)
+	}
+	want := []string{"vm-01", "vm-03"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't filter resources\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestFilteredListFromResourceGroupScopes(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var value []interface{}
+		switch r.URL.Path {
+		case "/providers/Microsoft.Management/managementGroups/platform/descendants":
+			value = []interface{}{
+				map[string]string{"type": "/providers/Microsoft.Management/managementGroups", "name": "child"},
+				map[string]string{"type": "/subscriptions", "name": "sub-a"},
+				map[string]string{"type": "/subscriptions", "name": "sub-b"},
+			}
+		case "/subscriptions/sub-a/resourcegroups":
+			value = []interface{}{
+				map[string]string{"name": "customer-1"},
+				map[string]string{"name": "customer-test"},
+				map[string]string{"name": "shared"},
+			}
+		case "/subscriptions/sub-b/resourcegroups":
+			value = []interface{}{map[string]string{"name": "customer-2"}}
+		case "/subscriptions/sub-a/resourceGroups/customer-1/resources":
+			value = []interface{}{map[string]string{"id": "/subscriptions/sub-a/resourceGroups/customer-1/providers/Microsoft.Web/sites/app-1", "name": "app-1"}}
+		case "/subscriptions/sub-b/resourceGroups/customer-2/resources":
+			value = []interface{}{map[string]string{"id": "/subscriptions/sub-b/resourceGroups/customer-2/providers/Microsoft.Web/sites/app-2", "name": "app-2"}}
+		default:
+			t.Errorf("unexpected request for %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": value})
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	var resourceGroup config.ResourceGroup
+	err := yaml.Unmarshal([]byte(`
+management_groups: ["platform"]
+resource_group_include_re: ["customer-.*"]
+resource_group_exclude_re: [".*-test"]
+resource_types: ["Microsoft.Web/sites"]
+metrics:
+  - name: "Http5xx"
+`), &resourceGroup)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	resources, err := ac.filteredListFromResourceGroup(resourceGroup)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, r := range resources {
+		got = append(got, r.Subscription+" "+r.Name)
+	}
+	want := []string{"sub-a app-1", "sub-b app-2"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't list resources of matching groups\ngot: %v\nwant: %v", got, want)
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+)
+
+// baselineQuery is the query of the metric baselines of a metric of a resource.
+type baselineQuery struct {
+	rm     resourceMeta
+	metric config.Metric
+	url    string
+}
+
+// baselineQueries returns the metric baseline queries of the metrics with a baseline, one per metric.
+// Rolled up resources are skipped.
+func baselineQueries(resources []resourceMeta) []baselineQuery {
+	var queries []baselineQuery
+	for _, rm := range resources {
+		if len(rm.options.Rollups) > 0 {
+			continue
+		}
+
+		var names []string
+		for name, metric := range rm.metricOptions {
+			if metric.Baseline.Enabled {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+
+		for _, name := range names {
+			metric := rm.metricOptions[name]
+			aggregation := metric.Baseline.Aggregation
+			if aggregation == "" {
+				aggregation = filterAggregations(metric.Aggregations)[0]
+			}
+			queries = append(queries, baselineQuery{
+				rm:     rm,
+				metric: metric,
+				url:    baselineURLFrom(rm.resourceID, rm.metricNamespace, metric.Name, aggregation, metric.Baseline.Sensitivity),
+			})
+		}
+	}
+	return queries
+}
+
+// extractBaselines exports the latest low and high thresholds of the baseline of a metric, next to its series.
+func (c *Collector) extractBaselines(w *seriesWriter, q baselineQuery, httpStatusCode int, data AzureMetricBaselineResponse) {
+	if httpStatusCode != 200 {
+		log.Printf("Received %d status for metric baselines of resource %s. %s", httpStatusCode, q.rm.resourceURL, data.APIError.Message)
+		return
+	}
+
+	// The baselines response doesn't hold the unit, which is needed for the metric name.
+	resourceType := GetResourceType(q.rm.resourceURL)
+	def, _ := ac.definitions.lookup(resourceType, q.rm.metricNamespace, q.metric.Name)
+	metricName, scale := metricNameFrom(q.rm.metricNamespace, q.metric.Name, def.Unit, sc.C.MetricNaming.NormalizeUnits)
+	if q.metric.Rename != "" {
+		metricName = q.metric.Rename
+	}
+	help := q.metric.Help
+	if help == "" {
+		help = metricHelp(q.rm, q.metric.Name, def.Unit)
+	}
+
+	for _, value := range data.Value {
+		if len(value.Properties.Baselines) == 0 {
+			log.Printf("No metric baseline returned for metric %s at target %s", q.metric.Name, q.rm.resourceURL)
+			continue
+		}
+		// Without a dimension filter, the first baseline is the one of the whole resource.
+		for _, d := range value.Properties.Baselines[0].Data {
+			if !strings.EqualFold(d.Sensitivity, q.metric.Baseline.Sensitivity) || len(d.LowThresholds) == 0 || len(d.HighThresholds) == 0 {
+				continue
+			}
+			labels := CreateMetricLabels(q.rm)
+			sensitivity := strings.ToLower(q.metric.Baseline.Sensitivity)
+			w.write(series{
+				name:     metricName + "_baseline_low",
+				help:     fmt.Sprintf("%s, low threshold of the %s sensitivity baseline", help, sensitivity),
+				labels:   labels,
+				value:    d.LowThresholds[len(d.LowThresholds)-1] * scale,
+				selector: q.rm.selector,
+			})
+			w.write(series{
+				name:     metricName + "_baseline_high",
+				help:     fmt.Sprintf("%s, high threshold of the %s sensitivity baseline", help, sensitivity),
+				labels:   labels,
+				value:    d.HighThresholds[len(d.HighThresholds)-1] * scale,
+				selector: q.rm.selector,
+			})
+		}
+	}
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestBaselineQueries(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	vm := "/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm"
+	q := newMetricQuery([]config.Metric{
+		{Name: "Percentage CPU", Aggregations: []string{"Maximum"}, Baseline: config.Baseline{Enabled: true, Sensitivity: "High"}},
+		{Name: "Network In Total", Baseline: config.Baseline{Enabled: true, Sensitivity: "Low", Aggregation: "Total"}},
+		{Name: "Disk Read Bytes"},
+	}, []string{"Average"}, nil, nil)
+	rm := resourceMeta{resourceID: vm, metrics: q.metrics, aggregations: q.aggregations, metricOptions: q.options}
+	rolledUp := rm
+	rolledUp.options.Rollups = []config.Rollup{{By: []string{"resource_group"}}}
+
+	queries := baselineQueries([]resourceMeta{rm, rolledUp})
+	var got []string
+	for _, b := range queries {
+		got = append(got, b.metric.Name)
+		if !strings.Contains(b.url, "/providers/microsoft.insights/metricBaselines?") {
+			t.Errorf("doesn't query metric baselines\ngot: %v", b.url)
+		}
+	}
+	if want := []string{"Network In Total", "Percentage CPU"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't query the baselines of the metrics of resources not rolled up\ngot: %v\nwant: %v", got, want)
+	}
+	if !strings.Contains(queries[0].url, "aggregation=total") || !strings.Contains(queries[0].url, "sensitivities=Low") {
+		t.Errorf("doesn't use the baseline settings\ngot: %v", queries[0].url)
+	}
+	if !strings.Contains(queries[1].url, "aggregation=maximum") || !strings.Contains(queries[1].url, "sensitivities=High") {
+		t.Errorf("doesn't default to the aggregation of the metric\ngot: %v", queries[1].url)
+	}
+}
+
+func TestExtractBaselines(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	sc.C.MetricNaming.NormalizeUnits = true
+	ac.definitions = newMetricDefinitionCache()
+	var definitions AzureMetricDefinitionResponse
+	err := json.Unmarshal([]byte(`{"value": [{"name": {"value": "Percentage CPU"}, "unit": "Percent"}]}`), &definitions)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ac.definitions.store(definitionsKeyFor("Microsoft.Compute/virtualMachines", ""), definitions.MetricDefinitionResponses, time.Now())
+
+	vm := "/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm"
+	metric := config.Metric{Name: "Percentage CPU", Aggregations: []string{"Average"}, Baseline: config.Baseline{Enabled: true, Sensitivity: "Medium"}}
+	rm := resourceMeta{resourceID: vm, metrics: "Percentage CPU", aggregations: metric.Aggregations}
+	rm.resourceURL = resourceURLFrom(vm, "", rm.metrics, rm.aggregations)
+
+	var data AzureMetricBaselineResponse
+	err = json.Unmarshal([]byte(`{"value": [{"name": "Percentage CPU", "properties": {"baselines": [{
+		"timestamps": ["2020-01-01T11:00:00Z", "2020-01-01T12:00:00Z"],
+		"data": [
+			{"sensitivity": "Low", "lowThresholds": [1, 2], "highThresholds": [90, 95]},
+			{"sensitivity": "Medium", "lowThresholds": [10, 20], "highThresholds": [60, 50]}
+		]
+	}]}}]}`), &data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	(&Collector{}).extractBaselines(newSeriesWriter(ch, nil), baselineQuery{rm: rm, metric: metric}, 200, data)
+	(&Collector{}).extractBaselines(newSeriesWriter(ch, nil), baselineQuery{rm: rm, metric: metric}, 404, AzureMetricBaselineResponse{})
+	close(ch)
+
+	got := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		desc := m.Desc().String()
+		got[desc[strings.Index(desc, `fqName: "`)+9:strings.Index(desc, `", help`)]] = pb.GetGauge().GetValue()
+	}
+	want := map[string]float64{"percentage_cpu_ratio_baseline_low": 0.2, "percentage_cpu_ratio_baseline_high": 0.5}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't export the latest baseline thresholds\ngot: %v\nwant: %v", got, want)
+	}
+}
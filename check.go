@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// checkMetrics validates the configured metrics against the metric definitions of a sample of the
+// selected resources: one resource for each resource type and metric settings. It returns the problems found.
+func (c *Collector) checkMetrics() ([]string, error) {
+	resources, incompleteResources, err := c.listSelectedResources()
+	if err != nil {
+		return nil, err
+	}
+	sample := sampleResources(append(resources, incompleteResources...))
+
+	children, err := c.batchListSubResources(sample)
+	if err != nil {
+		return nil, err
+	}
+	sample = append(sample, sampleResources(children)...)
+
+	if err := ac.batchLookupMetricDefinitions(sample); err != nil {
+		return nil, err
+	}
+
+	var problems []string
+	for _, rm := range sample {
+		resourceType := GetResourceType(rm.resourceURL)
+		if definitions, _ := ac.definitions.all(resourceType, rm.metricNamespace); len(rm.metricFilters) > 0 && len(definitions) == 0 {
+			problems = append(problems, fmt.Sprintf("No metric definitions to select metrics from for %s%s (resource %s)",
+				resourceType, inNamespace(rm.metricNamespace), rm.resourceID))
+		}
+	}
+
+	queries := planQueries(sample)
+	if err := ac.batchLookupMetricDefinitions(queries); err != nil {
+		return nil, err
+	}
+
+	for _, q := range queries {
+		resourceType := GetResourceType(q.resourceURL)
+		if definitions, _ := ac.definitions.all(resourceType, q.metricNamespace); len(definitions) == 0 {
+			problems = append(problems, fmt.Sprintf("No metric definitions found for %s%s, check the metric namespace (resource %s)",
+				resourceType, inNamespace(q.metricNamespace), q.resourceID))
+			continue
+		}
+
+		for _, name := range strings.Split(q.metrics, ",") {
+			def, ok := ac.definitions.lookup(resourceType, q.metricNamespace, name)
+			if !ok {
+				problems = append(problems, fmt.Sprintf("Unknown metric %q for %s%s (resource %s)",
+					name, resourceType, inNamespace(q.metricNamespace), q.resourceID))
+				continue
+			}
+
+			if def.IsDimensionRequired {
+				problems = append(problems, fmt.Sprintf("Metric %q of %s requires a dimension filter (resource %s)",
+					name, resourceType, q.resourceID))
+			}
+
+			// The default aggregations are requested for all metrics, only check configured ones.
+			metric := q.metricOptions[strings.ToLower(name)]
+			if len(def.SupportedAggregationTypes) == 0 || reflect.DeepEqual(metric.Aggregations, filterAggregations(nil)) {
+				continue
+			}
+			for _, a := range metric.Aggregations {
+				if !hasState(def.SupportedAggregationTypes, a) {
+					problems = append(problems, fmt.Sprintf("Aggregation %s is not supported by metric %q of %s, supported aggregations are %v (resource %s)",
+						a, name, resourceType, def.SupportedAggregationTypes, q.resourceID))
+				}
+			}
+		}
+	}
+	return problems, nil
+}
+
+// sampleResources returns the first resource for each resource type, metric namespace and metrics.
+func sampleResources(resources []resourceMeta) []resourceMeta {
+	var sample []resourceMeta
+	seen := make(map[string]bool)
+	for _, rm := range resources {
+		key := strings.ToLower(fmt.Sprintf("%s|%s|%s|%v|%d", GetResourceType(rm.resourceURL), rm.metricNamespace, rm.metrics, rm.aggregations, len(rm.metricFilters)))
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+		sample = append(sample, rm)
+	}
+	return sample
+}
+
+func inNamespace(metricNamespace string) string {
+	if metricNamespace == "" {
+		return ""
+	}
+	return fmt.Sprintf(" in metric namespace %q", metricNamespace)
+}
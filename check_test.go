@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestCheckMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"value": []interface{}{
+				fakeResource("rg", "vm-01"),
+				fakeResource("rg", "vm-02"),
+			}})
+			return
+		}
+
+		var batch batchBody
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		var responses []map[string]interface{}
+		for _, req := range batch.Requests {
+			var definitions []map[string]interface{}
+			if !strings.Contains(req.RelativeURL, "metricnamespace") {
+				definitions = []map[string]interface{}{
+					{"name": map[string]string{"value": "Percentage CPU"}, "supportedAggregationTypes": []string{"Average", "Minimum", "Maximum"}},
+					{"name": map[string]string{"value": "Disk Read Bytes"}, "isDimensionRequired": true},
+				}
+			}
+			responses = append(responses, map[string]interface{}{
+				"name":           req.Name,
+				"httpStatusCode": 200,
+				"content":        map[string]interface{}{"value": definitions},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+	ac.definitions = newMetricDefinitionCache()
+
+	err := yaml.Unmarshal([]byte(`
+- resource_types: ["Microsoft.Compute/virtualMachines"]
+  aggregations: [Average, Total]
+  metrics:
+  - name: "Percentage CPU"
+  - name: "Disk Read Bytes"
+  - name: "Percentage CUP"
+  - name: 'Memory\Available Bytes'
+    metric_namespace: "Azure.VM.Windows.GuestMetric"
+`), &sc.C.ResourceTypes)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	problems, err := (&Collector{}).checkMetrics()
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []string{
+		`Aggregation Total is not supported by metric "Percentage CPU"`,
+		`Metric "Disk Read Bytes" of Microsoft.Compute/virtualMachines requires a dimension filter`,
+		`Unknown metric "Percentage CUP"`,
+		`No metric definitions found for Microsoft.Compute/virtualMachines in metric namespace "Azure.VM.Windows.GuestMetric"`,
+	}
+	if len(problems) != len(want) {
+		t.Fatalf("doesn't report problems once per sample\ngot: %q", problems)
+	}
+	for i, p := range problems {
+		if !strings.HasPrefix(p, want[i]) {
+			t.Errorf("doesn't report problem\ngot: %v\nwant: %v", p, want[i])
+		}
+	}
+}
+
+func TestReloadConfigStrict(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"value": []interface{}{fakeResource("rg", "vm-01")}})
+			return
+		}
+
+		var batch batchBody
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+		var responses []map[string]interface{}
+		for _, req := range batch.Requests {
+			responses = append(responses, map[string]interface{}{
+				"name":           req.Name,
+				"httpStatusCode": 200,
+				"content":        map[string]interface{}{"value": []map[string]interface{}{{"name": map[string]string{"value": "Percentage CPU"}}}},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+	previous := sc.C
+
+	dir, err := ioutil.TempDir("", "config")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "azure.yml")
+	writeConfig := func(metric string) {
+		conf := fmt.Sprintf(`
+resource_manager_url: %s
+credentials:
+  subscription_id: %s
+resource_types:
+- resource_types: ["Microsoft.Compute/virtualMachines"]
+  metrics:
+  - name: %q
+`, srv.URL, testSubscriptionID, metric)
+		if err := ioutil.WriteFile(path, []byte(conf), 0644); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+
+	defer func(file string, strict bool) { *configFile, *strictConfig = file, strict }(*configFile, *strictConfig)
+	*configFile, *strictConfig = path, true
+
+	ac.definitions = newMetricDefinitionCache()
+	writeConfig("Percentage CUP")
+	if err := reloadConfig(); err == nil {
+		t.Errorf("expected error reloading a config with an unknown metric")
+	}
+	if sc.C != previous {
+		t.Errorf("doesn't keep the previous config when the check fails")
+	}
+
+	ac.definitions = newMetricDefinitionCache()
+	writeConfig("Percentage CPU")
+	if err := reloadConfig(); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if sc.C == previous || sc.C.ResourceTypes[0].Metrics[0].Name != "Percentage CPU" {
+		t.Errorf("doesn't reload the config")
+	}
+}
@@ -6,18 +6,32 @@ import (
 	"regexp"
 	"strings"
 	"sync"
+	"text/template"
+	"time"
 
 	yaml "gopkg.in/yaml.v2"
 )
 
 // Config - Azure exporter configuration
 type Config struct {
-	ActiveDirectoryAuthorityURL string          `yaml:"active_directory_authority_url"`
-	ResourceManagerURL          string          `yaml:"resource_manager_url"`
-	Credentials                 Credentials     `yaml:"credentials"`
-	Targets                     []Target        `yaml:"targets"`
-	ResourceGroups              []ResourceGroup `yaml:"resource_groups"`
-	ResourceTags                []ResourceTag   `yaml:"resource_tags"`
+	ActiveDirectoryAuthorityURL string           `yaml:"active_directory_authority_url"`
+	ResourceManagerURL          string           `yaml:"resource_manager_url"`
+	Credentials                 Credentials      `yaml:"credentials"`
+	Targets                     []Target         `yaml:"targets"`
+	ResourceGroups              []ResourceGroup  `yaml:"resource_groups"`
+	ResourceTags                []ResourceTag    `yaml:"resource_tags"`
+	ResourceGraphs              []ResourceGraph  `yaml:"resource_graph"`
+	ResourceTypes               []ResourceType   `yaml:"resource_types"`
+	TagLabels                   []string         `yaml:"tag_labels"`
+	InheritResourceGroupTags    bool             `yaml:"inherit_resource_group_tags"`
+	MetricRelabelConfigs        []*RelabelConfig `yaml:"metric_relabel_configs"`
+	MetricNaming                MetricNaming     `yaml:"metric_naming"`
+	TotalCounters               TotalCounters    `yaml:"total_counters"`
+	LateData                    LateData         `yaml:"late_data"`
+	// MaxResources and MaxSeries limit the resources queried and the series exported, 0 is unlimited.
+	// MaxResources doesn't count sub resources.
+	MaxResources int `yaml:"max_resources"`
+	MaxSeries    int `yaml:"max_series"`
 
 	// Catches all undefined fields and must be empty after parsing.
 	XXX map[string]interface{} `yaml:",inline"`
@@ -64,6 +78,14 @@ func (c *Config) Validate() (err error) {
 			return err
 		}
 
+		if err := c.validateMetrics(t.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateSelectorOptions(t.SelectorOptions); err != nil {
+			return err
+		}
+
 		if len(t.Resource) == 0 {
 			return fmt.Errorf("name needs to be specified in each resource")
 		}
@@ -72,8 +94,8 @@ func (c *Config) Validate() (err error) {
 			return fmt.Errorf("Resource path %q must start with a /", t.Resource)
 		}
 
-		if len(t.Metrics) == 0 {
-			return fmt.Errorf("At least one metric needs to be specified in each resource")
+		if len(t.Metrics) == 0 && len(t.MetricNameIncludeRe) == 0 && len(t.MetricNameExcludeRe) == 0 {
+			return fmt.Errorf("At least one metric or metric_name_include_re needs to be specified in each resource")
 		}
 	}
 
@@ -82,16 +104,32 @@ func (c *Config) Validate() (err error) {
 			return err
 		}
 
-		if len(t.ResourceGroup) == 0 {
-			return fmt.Errorf("resource_group needs to be specified in each resource group")
+		if err := c.validateMetrics(t.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateSelectorOptions(t.SelectorOptions); err != nil {
+			return err
+		}
+
+		if len(t.ResourceGroup) == 0 && len(t.ResourceGroupIncludeRe) == 0 && len(t.ResourceGroupExcludeRe) == 0 {
+			return fmt.Errorf("resource_group or resource_group_include_re needs to be specified in each resource group")
+		}
+
+		if len(t.ResourceGroup) != 0 && (len(t.ResourceGroupIncludeRe) != 0 || len(t.ResourceGroupExcludeRe) != 0) {
+			return fmt.Errorf("resource_group can't be combined with resource_group_include_re and resource_group_exclude_re")
+		}
+
+		if len(t.ResourceGroup) != 0 && len(t.ManagementGroups) != 0 {
+			return fmt.Errorf("resource_group can't be combined with management_groups, use resource_group_include_re to match resource groups across subscriptions")
 		}
 
 		if len(t.ResourceTypes) == 0 {
 			return fmt.Errorf("At lease one resource type needs to be specified in each resource group")
 		}
 
-		if len(t.Metrics) == 0 {
-			return fmt.Errorf("At least one metric needs to be specified in each resource group")
+		if len(t.Metrics) == 0 && len(t.MetricNameIncludeRe) == 0 && len(t.MetricNameExcludeRe) == 0 {
+			return fmt.Errorf("At least one metric or metric_name_include_re needs to be specified in each resource group")
 		}
 	}
 
@@ -100,22 +138,149 @@ func (c *Config) Validate() (err error) {
 			return err
 		}
 
-		if len(t.ResourceTagName) == 0 {
-			return fmt.Errorf("resource_tag_name needs to be specified in each resource tag")
+		if err := c.validateMetrics(t.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateSelectorOptions(t.SelectorOptions); err != nil {
+			return err
+		}
+
+		if !t.ResourceTagSelector.IsEmpty() {
+			if len(t.ResourceTagName) != 0 || len(t.ResourceTagValue) != 0 {
+				return fmt.Errorf("resource_tag_selector can't be combined with resource_tag_name and resource_tag_value")
+			}
+		} else {
+			if len(t.ResourceTagName) == 0 {
+				return fmt.Errorf("resource_tag_name or resource_tag_selector needs to be specified in each resource tag")
+			}
+
+			if len(t.ResourceTagValue) == 0 {
+				return fmt.Errorf("resource_tag_value needs to be specified in each resource tag")
+			}
+		}
+
+		if len(t.Metrics) == 0 && len(t.MetricNameIncludeRe) == 0 && len(t.MetricNameExcludeRe) == 0 {
+			return fmt.Errorf("At least one metric or metric_name_include_re needs to be specified in each resource tag")
+		}
+	}
+
+	for _, t := range c.ResourceGraphs {
+		if err := c.validateAggregations(t.Aggregations); err != nil {
+			return err
+		}
+
+		if err := c.validateMetrics(t.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateSelectorOptions(t.SelectorOptions); err != nil {
+			return err
+		}
+
+		if len(t.Query) == 0 {
+			return fmt.Errorf("query needs to be specified in each resource graph")
+		}
+
+		if len(t.Metrics) == 0 && len(t.MetricNameIncludeRe) == 0 && len(t.MetricNameExcludeRe) == 0 {
+			return fmt.Errorf("At least one metric or metric_name_include_re needs to be specified in each resource graph")
+		}
+	}
+
+	for _, t := range c.ResourceTypes {
+		if err := c.validateAggregations(t.Aggregations); err != nil {
+			return err
+		}
+
+		if err := c.validateMetrics(t.Metrics); err != nil {
+			return err
+		}
+
+		if err := c.validateSelectorOptions(t.SelectorOptions); err != nil {
+			return err
+		}
+
+		if len(t.ResourceTypes) == 0 {
+			return fmt.Errorf("At least one resource type needs to be specified in each resource type selector")
+		}
+
+		if len(t.Metrics) == 0 && len(t.MetricNameIncludeRe) == 0 && len(t.MetricNameExcludeRe) == 0 {
+			return fmt.Errorf("At least one metric or metric_name_include_re needs to be specified in each resource type selector")
+		}
+	}
+
+	if err := c.validateMetricNaming(); err != nil {
+		return err
+	}
+
+	if c.MaxResources < 0 || c.MaxSeries < 0 {
+		return fmt.Errorf("max_resources and max_series can't be negative")
+	}
+
+	return nil
+}
+
+var metricNameRe = regexp.MustCompile("^[a-zA-Z_:][a-zA-Z0-9_:]*$")
+
+func (c *Config) validateMetrics(metrics Metrics) error {
+	if metrics.All() {
+		return nil
+	}
+
+	for _, m := range metrics {
+		if len(m.Name) == 0 {
+			return fmt.Errorf("name needs to be specified in each metric")
+		}
+
+		if err := c.validateAggregations(m.Aggregations); err != nil {
+			return err
 		}
 
-		if len(t.ResourceTagValue) == 0 {
-			return fmt.Errorf("resource_tag_value needs to be specified in each resource tag")
+		if m.Rename != "" && !metricNameRe.MatchString(m.Rename) {
+			return fmt.Errorf("%q is not a valid metric name to rename %s to", m.Rename, m.Name)
 		}
 
-		if len(t.Metrics) == 0 {
-			return fmt.Errorf("At least one metric needs to be specified in each resource tag")
+		if m.Baseline.Aggregation != "" {
+			if err := c.validateAggregations([]string{m.Baseline.Aggregation}); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
 
+var metricSuffixRe = regexp.MustCompile("^[a-zA-Z0-9_:]*$")
+
+func (c *Config) validateMetricNaming() error {
+	n := c.MetricNaming
+	if n.Mode != "" && n.Mode != NamingSuffix && n.Mode != NamingLabel {
+		return fmt.Errorf("metric_naming mode must be %q or %q, got %q", NamingSuffix, NamingLabel, n.Mode)
+	}
+
+	if n.Mode == NamingLabel && len(n.Suffixes) != 0 {
+		return fmt.Errorf("metric_naming suffixes can't be combined with the %q mode", NamingLabel)
+	}
+
+	seen := map[string]string{}
+	for _, a := range validAggregations {
+		suffix := n.Suffix(a)
+		if !metricSuffixRe.MatchString(suffix) {
+			return fmt.Errorf("%q is not a valid metric name suffix", suffix)
+		}
+		if other, ok := seen[suffix]; ok {
+			return fmt.Errorf("aggregations %s and %s can't have the same suffix %q", other, a, suffix)
+		}
+		seen[suffix] = a
+	}
+
+	var aggregations []string
+	for a := range n.Suffixes {
+		aggregations = append(aggregations, a)
+	}
+	return c.validateAggregations(aggregations)
+}
+
 func (c *Config) validateAggregations(aggregations []string) error {
 	for _, a := range aggregations {
 		ok := false
@@ -133,6 +298,74 @@ func (c *Config) validateAggregations(aggregations []string) error {
 	return nil
 }
 
+var (
+	labelNameRe    = regexp.MustCompile("^[a-zA-Z_][a-zA-Z0-9_]*$")
+	reservedLabels = []string{"resource_group", "resource_name", "sub_resource_name", "parent_resource_name", "aggregation", "metric"}
+)
+
+var validPowerStates = []string{"running", "stopped", "deallocated", "starting", "stopping", "deallocating"}
+
+func (c *Config) validateSelectorOptions(o SelectorOptions) error {
+	for _, p := range o.PowerStates {
+		ok := false
+		for _, valid := range validPowerStates {
+			if strings.EqualFold(p, valid) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return fmt.Errorf("%s is not one of the valid power states (%v)", p, validPowerStates)
+		}
+	}
+
+	for name := range o.Labels {
+		if !labelNameRe.MatchString(name) {
+			return fmt.Errorf("%q is not a valid label name", name)
+		}
+		for _, reserved := range reservedLabels {
+			if name == reserved {
+				return fmt.Errorf("label %q is reserved by the exporter", name)
+			}
+		}
+	}
+
+	if o.MaxResources < 0 || o.MaxSeries < 0 {
+		return fmt.Errorf("max_resources and max_series can't be negative")
+	}
+
+	for _, r := range o.Rollups {
+		if len(r.By) == 0 {
+			return fmt.Errorf("At least one label needs to be specified in 'by' of each rollup")
+		}
+		for _, name := range r.By {
+			if !labelNameRe.MatchString(name) {
+				return fmt.Errorf("%q is not a valid label name in rollup", name)
+			}
+		}
+	}
+
+	for _, s := range o.SubResources {
+		if err := c.validateAggregations(s.Aggregations); err != nil {
+			return err
+		}
+
+		if err := c.validateMetrics(s.Metrics); err != nil {
+			return err
+		}
+
+		if len(s.ResourceType) == 0 || strings.Contains(s.ResourceType, "/") {
+			return fmt.Errorf("resource_type needs to be specified as a single child type (e.g. blobServices) in each sub resource")
+		}
+
+		if len(s.Metrics) == 0 && len(s.MetricNameIncludeRe) == 0 && len(s.MetricNameExcludeRe) == 0 {
+			return fmt.Errorf("At least one metric or metric_name_include_re needs to be specified in each sub resource")
+		}
+	}
+
+	return nil
+}
+
 // Credentials - Azure credentials
 type Credentials struct {
 	SubscriptionID string `yaml:"subscription_id"`
@@ -145,51 +378,276 @@ type Credentials struct {
 
 // Target represents Azure target resource and its associated metric definitions
 type Target struct {
-	Resource        string   `yaml:"resource"`
-	MetricNamespace string   `yaml:"metric_namespace"`
-	Metrics         []Metric `yaml:"metrics"`
-	Aggregations    []string `yaml:"aggregations"`
+	Resource            string   `yaml:"resource"`
+	MetricNamespace     string   `yaml:"metric_namespace"`
+	Metrics             Metrics  `yaml:"metrics"`
+	MetricNameIncludeRe []Regexp `yaml:"metric_name_include_re"`
+	MetricNameExcludeRe []Regexp `yaml:"metric_name_exclude_re"`
+	Aggregations        []string `yaml:"aggregations"`
+	SelectorOptions     `yaml:",inline"`
 
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
-// ResourceGroup represents Azure target resource group and its associated metric definitions
+// ResourceGroup represents Azure target resource groups and their associated metric definitions.
+// Groups are looked up in the configured subscription, or in all subscriptions below the management groups.
 type ResourceGroup struct {
-	ResourceGroup         string   `yaml:"resource_group"`
-	MetricNamespace       string   `yaml:"metric_namespace"`
-	ResourceTypes         []string `yaml:"resource_types"`
+	ResourceGroup          string   `yaml:"resource_group"`
+	ResourceGroupIncludeRe []Regexp `yaml:"resource_group_include_re"`
+	ResourceGroupExcludeRe []Regexp `yaml:"resource_group_exclude_re"`
+	ManagementGroups       []string `yaml:"management_groups"`
+	MetricNamespace        string   `yaml:"metric_namespace"`
+	ResourceTypes          []string `yaml:"resource_types"`
+	ResourceNameIncludeRe  []Regexp `yaml:"resource_name_include_re"`
+	ResourceNameExcludeRe  []Regexp `yaml:"resource_name_exclude_re"`
+	Metrics                Metrics  `yaml:"metrics"`
+	MetricNameIncludeRe    []Regexp `yaml:"metric_name_include_re"`
+	MetricNameExcludeRe    []Regexp `yaml:"metric_name_exclude_re"`
+	Aggregations           []string `yaml:"aggregations"`
+	SelectorOptions        `yaml:",inline"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// ResourceTag selects resources with tag name and tag value, or with a tag selector expression
+type ResourceTag struct {
+	ResourceTagName     string      `yaml:"resource_tag_name"`
+	ResourceTagValue    string      `yaml:"resource_tag_value"`
+	ResourceTagSelector TagSelector `yaml:"resource_tag_selector"`
+	MetricNamespace     string      `yaml:"metric_namespace"`
+	ResourceTypes       []string    `yaml:"resource_types"`
+	Metrics             Metrics     `yaml:"metrics"`
+	MetricNameIncludeRe []Regexp    `yaml:"metric_name_include_re"`
+	MetricNameExcludeRe []Regexp    `yaml:"metric_name_exclude_re"`
+	Aggregations        []string    `yaml:"aggregations"`
+	SelectorOptions     `yaml:",inline"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// ResourceGraph selects resources returned by an Azure Resource Graph query.
+// The query runs against the configured subscription unless subscriptions or management groups are given.
+type ResourceGraph struct {
+	Query               string   `yaml:"query"`
+	Subscriptions       []string `yaml:"subscriptions"`
+	ManagementGroups    []string `yaml:"management_groups"`
+	MetricNamespace     string   `yaml:"metric_namespace"`
+	Metrics             Metrics  `yaml:"metrics"`
+	MetricNameIncludeRe []Regexp `yaml:"metric_name_include_re"`
+	MetricNameExcludeRe []Regexp `yaml:"metric_name_exclude_re"`
+	Aggregations        []string `yaml:"aggregations"`
+	SelectorOptions     `yaml:",inline"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// ResourceType selects resources of the given types across the whole subscription
+type ResourceType struct {
+	ResourceTypes          []string `yaml:"resource_types"`
+	Locations              []string `yaml:"locations"`
+	ResourceGroupIncludeRe []Regexp `yaml:"resource_group_include_re"`
+	ResourceGroupExcludeRe []Regexp `yaml:"resource_group_exclude_re"`
+	ResourceNameIncludeRe  []Regexp `yaml:"resource_name_include_re"`
+	ResourceNameExcludeRe  []Regexp `yaml:"resource_name_exclude_re"`
+	MetricNamespace        string   `yaml:"metric_namespace"`
+	Metrics                Metrics  `yaml:"metrics"`
+	MetricNameIncludeRe    []Regexp `yaml:"metric_name_include_re"`
+	MetricNameExcludeRe    []Regexp `yaml:"metric_name_exclude_re"`
+	Aggregations           []string `yaml:"aggregations"`
+	SelectorOptions        `yaml:",inline"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// SelectorOptions holds the options shared by targets and all resource selectors
+type SelectorOptions struct {
+	SubResources       []SubResource `yaml:"sub_resources"`
+	ProvisioningStates []string      `yaml:"provisioning_states"`
+	PowerStates        []string      `yaml:"power_states"`
+	// ExportPowerState exports the power state of the virtual machines as azure_vm_power_state.
+	ExportPowerState bool                `yaml:"export_power_state"`
+	Labels           map[string]Template `yaml:"labels"`
+	// TagLabels overrides the global tag_labels when set.
+	TagLabels                []string `yaml:"tag_labels"`
+	InheritResourceGroupTags bool     `yaml:"inherit_resource_group_tags"`
+	// Rollups aggregate the series of the resources by some of their labels instead of exporting them per resource.
+	Rollups []Rollup `yaml:"rollups"`
+	// MaxResources and MaxSeries limit the resources queried and the series exported for the selector, 0 is unlimited.
+	MaxResources int `yaml:"max_resources"`
+	MaxSeries    int `yaml:"max_series"`
+}
+
+// Rollup groups the series of resources by labels, and exports one series per group
+type Rollup struct {
+	By []string `yaml:"by,flow"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// SubResource selects child resources of each matched resource, queried with their own metrics
+type SubResource struct {
+	ResourceType          string   `yaml:"resource_type"`
 	ResourceNameIncludeRe []Regexp `yaml:"resource_name_include_re"`
 	ResourceNameExcludeRe []Regexp `yaml:"resource_name_exclude_re"`
-	Metrics               []Metric `yaml:"metrics"`
+	MetricNamespace       string   `yaml:"metric_namespace"`
+	Metrics               Metrics  `yaml:"metrics"`
+	MetricNameIncludeRe   []Regexp `yaml:"metric_name_include_re"`
+	MetricNameExcludeRe   []Regexp `yaml:"metric_name_exclude_re"`
 	Aggregations          []string `yaml:"aggregations"`
 
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
-// ResourceTag selects resources with tag name and tag value
-type ResourceTag struct {
-	ResourceTagName  string   `yaml:"resource_tag_name"`
-	ResourceTagValue string   `yaml:"resource_tag_value"`
-	MetricNamespace  string   `yaml:"metric_namespace"`
-	ResourceTypes    []string `yaml:"resource_types"`
-	Metrics          []Metric `yaml:"metrics"`
-	Aggregations     []string `yaml:"aggregations"`
+// Metric naming modes.
+const (
+	// NamingSuffix exports one metric per aggregation, named with the aggregation suffix.
+	NamingSuffix = "suffix"
+	// NamingLabel exports one metric per Azure metric, with an aggregation label.
+	NamingLabel = "label"
+)
+
+var defaultAggregationSuffixes = map[string]string{
+	"Total":   "_total",
+	"Average": "_average",
+	"Minimum": "_min",
+	"Maximum": "_max",
+}
+
+// MetricNaming configures how the aggregations of an Azure metric are exported
+type MetricNaming struct {
+	Mode string `yaml:"mode"`
+	// Suffixes overrides the suffix of each aggregation in suffix mode, keyed by aggregation.
+	Suffixes map[string]string `yaml:"suffixes"`
+	// NormalizeUnits converts values to Prometheus base units, named with the base unit.
+	NormalizeUnits bool `yaml:"normalize_units"`
 
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
+// Suffix returns the metric name suffix of an aggregation in suffix mode.
+func (n MetricNaming) Suffix(aggregation string) string {
+	if suffix, ok := n.Suffixes[aggregation]; ok {
+		return suffix
+	}
+	return defaultAggregationSuffixes[aggregation]
+}
+
+// TotalCounters configures exporting the Total aggregation as monotonic counters, accumulating the
+// Total of each time bucket instead of exporting the Total of the latest bucket as a gauge
+type TotalCounters struct {
+	Enabled bool `yaml:"enabled"`
+	// StateFile keeps the counters across restarts when set.
+	StateFile string `yaml:"state_file"`
+	// Lookback is how far back time buckets are queried, to catch up on the buckets since the previous scrape.
+	Lookback time.Duration `yaml:"lookback"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// LookbackOrDefault returns the configured lookback, 10 minutes by default.
+func (t TotalCounters) LookbackOrDefault() time.Duration {
+	if t.Lookback > 0 {
+		return t.Lookback
+	}
+	return 10 * time.Minute
+}
+
+// LateData configures re-querying recent time buckets, to export the values Azure revised after first
+// publishing them with the timestamp of their bucket
+type LateData struct {
+	Enabled bool `yaml:"enabled"`
+	// Lookback is how far back time buckets are re-queried.
+	Lookback time.Duration `yaml:"lookback"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// LookbackOrDefault returns the configured lookback, 5 minutes by default.
+func (l LateData) LookbackOrDefault() time.Duration {
+	if l.Lookback > 0 {
+		return l.Lookback
+	}
+	return 5 * time.Minute
+}
+
+// AllMetrics selects every metric of the metric definitions of each resource, as "metrics: all".
+const AllMetrics = "all"
+
+// Metrics lists the metrics of a selector, or holds AllMetrics.
+type Metrics []Metric
+
+// All reports whether every metric of the metric definitions is selected.
+func (m Metrics) All() bool {
+	return len(m) == 1 && m[0].all
+}
+
 // Metric defines metric name
 type Metric struct {
 	Name string `yaml:"name"`
+	// Aggregations and MetricNamespace override the ones of the selector for this metric.
+	Aggregations    []string `yaml:"aggregations"`
+	MetricNamespace string   `yaml:"metric_namespace"`
+	// Rename replaces the metric name built from the Azure metric name, unit and namespace.
+	Rename string `yaml:"rename"`
+	Help   string `yaml:"help"`
+	// Baseline also queries the metric baselines of Azure Monitor dynamic thresholds.
+	Baseline Baseline `yaml:"baseline"`
+
+	all bool
 
 	XXX map[string]interface{} `yaml:",inline"`
 }
 
+var validSensitivities = []string{"Low", "Medium", "High"}
+
+// Baseline configures the metric baselines queried for a metric, either true or a map
+type Baseline struct {
+	Enabled bool `yaml:"-"`
+	// Sensitivity is Low, Medium or High, Medium by default.
+	Sensitivity string `yaml:"sensitivity"`
+	// Aggregation defaults to the first aggregation of the metric.
+	Aggregation string `yaml:"aggregation"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (b *Baseline) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var enabled bool
+	if err := unmarshal(&enabled); err == nil {
+		*b = Baseline{Enabled: enabled, Sensitivity: "Medium"}
+		return nil
+	}
+
+	*b = Baseline{Sensitivity: "Medium"}
+	type plain Baseline
+	if err := unmarshal((*plain)(b)); err != nil {
+		return err
+	}
+	if err := checkOverflow(b.XXX, "baseline"); err != nil {
+		return err
+	}
+	b.Enabled = true
+
+	for _, valid := range validSensitivities {
+		if strings.EqualFold(b.Sensitivity, valid) {
+			b.Sensitivity = valid
+			return nil
+		}
+	}
+	return fmt.Errorf("%s is not one of the valid baseline sensitivities (%v)", b.Sensitivity, validSensitivities)
+}
+
 // Regexp encapsulates a regexp.Regexp and makes it YAML marshalable.
 type Regexp struct {
 	*regexp.Regexp
 }
 
+// Template encapsulates a text/template.Template and makes it YAML marshalable.
+type Template struct {
+	*template.Template
+}
+
 func checkOverflow(m map[string]interface{}, ctx string) error {
 	if len(m) > 0 {
 		var keys []string
@@ -261,6 +719,109 @@ func (s *ResourceGroup) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	return nil
 }
 
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ResourceGraph) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ResourceGraph
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *ResourceType) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain ResourceType
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *SubResource) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain SubResource
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (r *Rollup) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain Rollup
+	if err := unmarshal((*plain)(r)); err != nil {
+		return err
+	}
+	if err := checkOverflow(r.XXX, "rollup"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (m *Metrics) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err == nil {
+		if s != AllMetrics {
+			return fmt.Errorf("metrics must be a list of metrics or %q, got %q", AllMetrics, s)
+		}
+		*m = Metrics{{all: true}}
+		return nil
+	}
+
+	var metrics []Metric
+	if err := unmarshal(&metrics); err != nil {
+		return err
+	}
+	*m = metrics
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *TotalCounters) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain TotalCounters
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *LateData) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain LateData
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (s *MetricNaming) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	type plain MetricNaming
+	if err := unmarshal((*plain)(s)); err != nil {
+		return err
+	}
+	if err := checkOverflow(s.XXX, "config"); err != nil {
+		return err
+	}
+	return nil
+}
+
 // UnmarshalYAML implements the yaml.Unmarshaler interface.
 func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	var s string
@@ -274,3 +835,17 @@ func (re *Regexp) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	re.Regexp = regex
 	return nil
 }
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (t *Template) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	tmpl, err := template.New("").Option("missingkey=zero").Parse(s)
+	if err != nil {
+		return err
+	}
+	t.Template = tmpl
+	return nil
+}
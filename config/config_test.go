@@ -0,0 +1,90 @@
+package config
+
+import (
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestMetricsUnmarshalYAML(t *testing.T) {
+	var cases = []struct {
+		config string
+		all    bool
+		count  int
+	}{
+		{"resource: /resourceGroups/rg\nmetrics: all", true, 1},
+		{"resource: /resourceGroups/rg\nmetrics:\n- name: Percentage CPU\n- name: Network In Total", false, 2},
+		{"resource: /resourceGroups/rg\nmetric_name_include_re: ['Percentage.*']", false, 0},
+	}
+
+	for _, c := range cases {
+		var target Target
+		if err := yaml.Unmarshal([]byte(c.config), &target); err != nil {
+			t.Errorf("unexpected error parsing %q: %v", c.config, err)
+			continue
+		}
+		if target.Metrics.All() != c.all || len(target.Metrics) != c.count {
+			t.Errorf("doesn't parse metrics of %q\ngot: %+v", c.config, target.Metrics)
+		}
+		config := Config{Targets: []Target{target}}
+		if err := config.Validate(); err != nil {
+			t.Errorf("unexpected error validating %q: %v", c.config, err)
+		}
+	}
+
+	var target Target
+	if err := yaml.Unmarshal([]byte("metrics: some"), &target); err == nil {
+		t.Errorf("expected error parsing metrics: some")
+	}
+}
+
+func TestBaselineUnmarshalYAML(t *testing.T) {
+	var cases = []struct {
+		config string
+		want   Baseline
+	}{
+		{"name: Percentage CPU", Baseline{}},
+		{"name: Percentage CPU\nbaseline: true", Baseline{Enabled: true, Sensitivity: "Medium"}},
+		{"name: Percentage CPU\nbaseline: false", Baseline{Sensitivity: "Medium"}},
+		{"name: Percentage CPU\nbaseline:\n  sensitivity: high\n  aggregation: Maximum", Baseline{Enabled: true, Sensitivity: "High", Aggregation: "Maximum"}},
+	}
+
+	for _, c := range cases {
+		var metric Metric
+		if err := yaml.Unmarshal([]byte(c.config), &metric); err != nil {
+			t.Errorf("unexpected error parsing %q: %v", c.config, err)
+			continue
+		}
+		if metric.Baseline.Enabled != c.want.Enabled || metric.Baseline.Sensitivity != c.want.Sensitivity || metric.Baseline.Aggregation != c.want.Aggregation {
+			t.Errorf("doesn't parse baseline of %q\ngot: %+v\nwant: %+v", c.config, metric.Baseline, c.want)
+		}
+	}
+
+	var metric Metric
+	if err := yaml.Unmarshal([]byte("name: Percentage CPU\nbaseline:\n  sensitivity: extreme"), &metric); err == nil {
+		t.Errorf("expected error parsing sensitivity extreme")
+	}
+}
+
+func TestValidateResourceGroupManagementGroups(t *testing.T) {
+	var cases = []struct {
+		config string
+		valid  bool
+	}{
+		{"resource_group: rg\nresource_types: [Microsoft.Compute/virtualMachines]\nmetrics: all", true},
+		{"management_groups: [platform]\nresource_group_include_re: ['rg-.*']\nresource_types: [Microsoft.Compute/virtualMachines]\nmetrics: all", true},
+		{"management_groups: [platform]\nresource_group: rg\nresource_types: [Microsoft.Compute/virtualMachines]\nmetrics: all", false},
+	}
+
+	for _, c := range cases {
+		var group ResourceGroup
+		if err := yaml.Unmarshal([]byte(c.config), &group); err != nil {
+			t.Errorf("unexpected error parsing %q: %v", c.config, err)
+			continue
+		}
+		config := Config{ResourceGroups: []ResourceGroup{group}}
+		if err := config.Validate(); (err == nil) != c.valid {
+			t.Errorf("doesn't validate %q\ngot: %v\nwant valid: %v", c.config, err, c.valid)
+		}
+	}
+}
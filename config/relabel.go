@@ -0,0 +1,167 @@
+package config
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/common/model"
+)
+
+// Relabel actions, with the same semantics as in Prometheus' metric_relabel_configs.
+const (
+	RelabelReplace   = "replace"
+	RelabelKeep      = "keep"
+	RelabelDrop      = "drop"
+	RelabelHashMod   = "hashmod"
+	RelabelLabelMap  = "labelmap"
+	RelabelLabelDrop = "labeldrop"
+	RelabelLabelKeep = "labelkeep"
+)
+
+var defaultRelabelRegex = Regexp{regexp.MustCompile("^(?:(.*))$")}
+
+// RelabelConfig is a rule rewriting the label set of a series before it is exported,
+// with the same semantics as a Prometheus relabel_config.
+type RelabelConfig struct {
+	SourceLabels []string `yaml:"source_labels,flow"`
+	Separator    string   `yaml:"separator"`
+	Regex        Regexp   `yaml:"regex"`
+	Modulus      uint64   `yaml:"modulus"`
+	TargetLabel  string   `yaml:"target_label"`
+	Replacement  string   `yaml:"replacement"`
+	Action       string   `yaml:"action"`
+
+	XXX map[string]interface{} `yaml:",inline"`
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (c *RelabelConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	*c = RelabelConfig{
+		Separator:   ";",
+		Regex:       defaultRelabelRegex,
+		Replacement: "$1",
+		Action:      RelabelReplace,
+	}
+	type plain RelabelConfig
+	if err := unmarshal((*plain)(c)); err != nil {
+		return err
+	}
+	if err := checkOverflow(c.XXX, "relabel_config"); err != nil {
+		return err
+	}
+	c.Action = strings.ToLower(c.Action)
+
+	switch c.Action {
+	case RelabelReplace:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel configuration for %s action requires 'target_label' value", c.Action)
+		}
+	case RelabelHashMod:
+		if c.TargetLabel == "" {
+			return fmt.Errorf("relabel configuration for %s action requires 'target_label' value", c.Action)
+		}
+		if c.Modulus == 0 {
+			return fmt.Errorf("relabel configuration for %s action requires 'modulus' value", c.Action)
+		}
+		if !model.LabelName(c.TargetLabel).IsValid() {
+			return fmt.Errorf("%q is invalid 'target_label' for %s action", c.TargetLabel, c.Action)
+		}
+	case RelabelKeep, RelabelDrop, RelabelLabelMap:
+	case RelabelLabelDrop, RelabelLabelKeep:
+		if len(c.SourceLabels) > 0 || c.TargetLabel != "" || c.Modulus != 0 ||
+			c.Separator != ";" || c.Replacement != "$1" {
+			return fmt.Errorf("%s action requires only 'regex', and no other fields", c.Action)
+		}
+	default:
+		return fmt.Errorf("unknown relabel action %q", c.Action)
+	}
+	return nil
+}
+
+// Relabel applies the relabel configurations to a label set, in order.
+// It returns nil if the series must be dropped.
+func Relabel(labels map[string]string, cfgs []*RelabelConfig) map[string]string {
+	out := make(map[string]string, len(labels))
+	for k, v := range labels {
+		out[k] = v
+	}
+
+	for _, cfg := range cfgs {
+		if out = relabel(out, cfg); out == nil {
+			return nil
+		}
+	}
+	return out
+}
+
+func relabel(labels map[string]string, cfg *RelabelConfig) map[string]string {
+	values := make([]string, 0, len(cfg.SourceLabels))
+	for _, name := range cfg.SourceLabels {
+		values = append(values, labels[name])
+	}
+	val := strings.Join(values, cfg.Separator)
+
+	switch cfg.Action {
+	case RelabelDrop:
+		if cfg.Regex.MatchString(val) {
+			return nil
+		}
+	case RelabelKeep:
+		if !cfg.Regex.MatchString(val) {
+			return nil
+		}
+	case RelabelReplace:
+		indexes := cfg.Regex.FindStringSubmatchIndex(val)
+		// If there is no match no replacement must take place.
+		if indexes == nil {
+			break
+		}
+		target := model.LabelName(cfg.Regex.ExpandString([]byte{}, cfg.TargetLabel, val, indexes))
+		if !target.IsValid() {
+			break
+		}
+		res := cfg.Regex.ExpandString([]byte{}, cfg.Replacement, val, indexes)
+		if len(res) == 0 {
+			delete(labels, string(target))
+			break
+		}
+		labels[string(target)] = string(res)
+	case RelabelHashMod:
+		sum := md5.Sum([]byte(val))
+		mod := binary.BigEndian.Uint64(sum[8:]) % cfg.Modulus
+		labels[cfg.TargetLabel] = fmt.Sprintf("%d", mod)
+	case RelabelLabelMap:
+		// Sort the names so that the result doesn't depend on map iteration order.
+		var names []string
+		for name := range labels {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		mapped := make(map[string]string)
+		for _, name := range names {
+			if cfg.Regex.MatchString(name) {
+				mapped[cfg.Regex.ReplaceAllString(name, cfg.Replacement)] = labels[name]
+			}
+		}
+		for name, value := range mapped {
+			labels[name] = value
+		}
+	case RelabelLabelDrop:
+		for name := range labels {
+			if cfg.Regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	case RelabelLabelKeep:
+		for name := range labels {
+			if !cfg.Regex.MatchString(name) {
+				delete(labels, name)
+			}
+		}
+	}
+	return labels
+}
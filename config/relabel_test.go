@@ -0,0 +1,126 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestRelabel(t *testing.T) {
+	labels := map[string]string{
+		"__name__":       "cpu_percent_average",
+		"resource_group": "prod-rg",
+		"resource_name":  "vm-01",
+		"tag_team":       "payments",
+		"dimension_lun":  "3",
+	}
+
+	var cases = []struct {
+		config string
+		want   map[string]string
+	}{
+		{
+			`[{source_labels: [resource_group], regex: "prod-.*", action: drop}]`,
+			nil,
+		},
+		{
+			`[{source_labels: [resource_group], regex: "dev-.*", action: keep}]`,
+			nil,
+		},
+		{
+			`[{source_labels: [resource_group], regex: "prod-.*", action: keep}, {regex: "dimension_.*", action: labeldrop}]`,
+			map[string]string{
+				"__name__":       "cpu_percent_average",
+				"resource_group": "prod-rg",
+				"resource_name":  "vm-01",
+				"tag_team":       "payments",
+			},
+		},
+		{
+			`[{source_labels: [resource_group, resource_name], separator: "/", regex: "prod-(.*)/(.*)", target_label: instance, replacement: "$1:$2"}]`,
+			map[string]string{
+				"__name__":       "cpu_percent_average",
+				"resource_group": "prod-rg",
+				"resource_name":  "vm-01",
+				"tag_team":       "payments",
+				"dimension_lun":  "3",
+				"instance":       "rg:vm-01",
+			},
+		},
+		{
+			`[{source_labels: [__name__], regex: "cpu_(.*)", target_label: __name__, replacement: "vm_cpu_$1"}, {regex: "__name__|resource_name", action: labelkeep}]`,
+			map[string]string{
+				"__name__":      "vm_cpu_percent_average",
+				"resource_name": "vm-01",
+			},
+		},
+		{
+			`[{regex: "tag_(.*)", replacement: "$1", action: labelmap}, {regex: "tag_.*|dimension_.*|resource_.*", action: labeldrop}]`,
+			map[string]string{
+				"__name__": "cpu_percent_average",
+				"team":     "payments",
+			},
+		},
+		{
+			`[{source_labels: [missing], target_label: resource_group, replacement: ""}, {regex: "__name__|resource_group", action: labelkeep}]`,
+			map[string]string{
+				"__name__": "cpu_percent_average",
+			},
+		},
+		{
+			`[{source_labels: [resource_name], regex: "nomatch", target_label: resource_group, replacement: "other"}, {regex: "__name__|resource_group", action: labelkeep}]`,
+			map[string]string{
+				"__name__":       "cpu_percent_average",
+				"resource_group": "prod-rg",
+			},
+		},
+	}
+
+	for _, c := range cases {
+		var cfgs []*RelabelConfig
+		if err := yaml.Unmarshal([]byte(c.config), &cfgs); err != nil {
+			t.Errorf("unexpected error parsing %s: %v", c.config, err)
+			continue
+		}
+		got := Relabel(labels, cfgs)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("doesn't relabel with %s\ngot: %v\nwant: %v", c.config, got, c.want)
+		}
+	}
+	if labels["dimension_lun"] != "3" || len(labels) != 5 {
+		t.Errorf("modified the input labels: %v", labels)
+	}
+}
+
+func TestRelabelHashMod(t *testing.T) {
+	var cfgs []*RelabelConfig
+	err := yaml.Unmarshal([]byte(`[{source_labels: [resource_name], target_label: shard, modulus: 4, action: hashmod}]`), &cfgs)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	first := Relabel(map[string]string{"resource_name": "vm-01"}, cfgs)
+	second := Relabel(map[string]string{"resource_name": "vm-01"}, cfgs)
+	if first["shard"] == "" || first["shard"] != second["shard"] {
+		t.Errorf("doesn't hash consistently\ngot: %v and %v", first, second)
+	}
+}
+
+func TestRelabelConfigInvalid(t *testing.T) {
+	var cases = []string{
+		`[{source_labels: [a], regex: "x"}]`,
+		`[{action: hashmod, target_label: shard}]`,
+		`[{action: hashmod, modulus: 2}]`,
+		`[{action: labeldrop, regex: "x", target_label: y}]`,
+		`[{action: rename}]`,
+		`[{action: keep, regex: "("}]`,
+		`[{action: keep, unknown: field}]`,
+	}
+
+	for _, c := range cases {
+		var cfgs []*RelabelConfig
+		if err := yaml.Unmarshal([]byte(c), &cfgs); err == nil {
+			t.Errorf("expected error parsing %s", c)
+		}
+	}
+}
@@ -0,0 +1,377 @@
+package config
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// TagSelector is a boolean expression matched against the tags of a resource, e.g.
+// "env in (prod, staging) AND team=payments AND NOT monitoring=off".
+//
+// Supported terms are "key" (tag exists), "key=value", "key!=value", "key=~regex",
+// "key!~regex", "key in (a, b)" and "key notin (a, b)". Terms are combined with AND,
+// OR, NOT and parentheses. Tag keys are matched case-insensitively, values are not.
+type TagSelector struct {
+	expr   tagExpr
+	source string
+}
+
+// ParseTagSelector parses a tag selector expression.
+func ParseTagSelector(s string) (*TagSelector, error) {
+	tokens, err := tokenizeTagSelector(s)
+	if err != nil {
+		return nil, err
+	}
+	p := &tagSelectorParser{tokens: tokens}
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok.kind != tokenEOF {
+		return nil, fmt.Errorf("unexpected %q in tag selector %q", tok.value, s)
+	}
+	return &TagSelector{expr: expr, source: s}, nil
+}
+
+// Matches reports whether the given tags satisfy the selector. An empty selector matches everything.
+func (ts TagSelector) Matches(tags map[string]string) bool {
+	if ts.expr == nil {
+		return true
+	}
+	return ts.expr.match(tags)
+}
+
+// IsEmpty reports whether no expression was configured.
+func (ts TagSelector) IsEmpty() bool {
+	return ts.expr == nil
+}
+
+func (ts TagSelector) String() string {
+	return ts.source
+}
+
+// UnmarshalYAML implements the yaml.Unmarshaler interface.
+func (ts *TagSelector) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var s string
+	if err := unmarshal(&s); err != nil {
+		return err
+	}
+	selector, err := ParseTagSelector(s)
+	if err != nil {
+		return err
+	}
+	*ts = *selector
+	return nil
+}
+
+type tagExpr interface {
+	match(tags map[string]string) bool
+}
+
+type andExpr []tagExpr
+
+func (e andExpr) match(tags map[string]string) bool {
+	for _, sub := range e {
+		if !sub.match(tags) {
+			return false
+		}
+	}
+	return true
+}
+
+type orExpr []tagExpr
+
+func (e orExpr) match(tags map[string]string) bool {
+	for _, sub := range e {
+		if sub.match(tags) {
+			return true
+		}
+	}
+	return false
+}
+
+type notExpr struct {
+	expr tagExpr
+}
+
+func (e notExpr) match(tags map[string]string) bool {
+	return !e.expr.match(tags)
+}
+
+type existsExpr struct {
+	key string
+}
+
+func (e existsExpr) match(tags map[string]string) bool {
+	_, ok := LookupTag(tags, e.key)
+	return ok
+}
+
+type valuesExpr struct {
+	key    string
+	values []string
+}
+
+func (e valuesExpr) match(tags map[string]string) bool {
+	value, ok := LookupTag(tags, e.key)
+	if !ok {
+		return false
+	}
+	for _, v := range e.values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+type regexExpr struct {
+	key string
+	re  *regexp.Regexp
+}
+
+func (e regexExpr) match(tags map[string]string) bool {
+	value, ok := LookupTag(tags, e.key)
+	return ok && e.re.MatchString(value)
+}
+
+// LookupTag returns the value of a tag, matching its key case-insensitively like Azure does.
+func LookupTag(tags map[string]string, key string) (string, bool) {
+	if value, ok := tags[key]; ok {
+		return value, true
+	}
+	for k, v := range tags {
+		if strings.EqualFold(k, key) {
+			return v, true
+		}
+	}
+	return "", false
+}
+
+type tokenKind int
+
+const (
+	tokenEOF tokenKind = iota
+	tokenWord
+	tokenString
+	tokenOperator
+)
+
+type token struct {
+	kind  tokenKind
+	value string
+}
+
+// keyword reports whether the token is the given unquoted keyword.
+func (t token) keyword(k string) bool {
+	return t.kind == tokenWord && strings.EqualFold(t.value, k)
+}
+
+func (t token) operator(op string) bool {
+	return t.kind == tokenOperator && t.value == op
+}
+
+func tokenizeTagSelector(s string) ([]token, error) {
+	var tokens []token
+	runes := []rune(s)
+	for i := 0; i < len(runes); {
+		r := runes[i]
+		switch {
+		case unicode.IsSpace(r):
+			i++
+		case r == '(' || r == ')' || r == ',':
+			tokens = append(tokens, token{tokenOperator, string(r)})
+			i++
+		case r == '=' || r == '!':
+			op := string(r)
+			if i+1 < len(runes) && (runes[i+1] == '=' || runes[i+1] == '~') {
+				op += string(runes[i+1])
+			}
+			tokens = append(tokens, token{tokenOperator, op})
+			i += len(op)
+		case r == '\'' || r == '"':
+			end := i + 1
+			for end < len(runes) && runes[end] != r {
+				end++
+			}
+			if end == len(runes) {
+				return nil, fmt.Errorf("unterminated string in tag selector %q", s)
+			}
+			tokens = append(tokens, token{tokenString, string(runes[i+1 : end])})
+			i = end + 1
+		default:
+			end := i
+			for end < len(runes) && !unicode.IsSpace(runes[end]) && !strings.ContainsRune("()=!,'\"", runes[end]) {
+				end++
+			}
+			tokens = append(tokens, token{tokenWord, string(runes[i:end])})
+			i = end
+		}
+	}
+	return tokens, nil
+}
+
+type tagSelectorParser struct {
+	tokens []token
+	pos    int
+}
+
+func (p *tagSelectorParser) peek() token {
+	if p.pos >= len(p.tokens) {
+		return token{kind: tokenEOF}
+	}
+	return p.tokens[p.pos]
+}
+
+func (p *tagSelectorParser) next() token {
+	tok := p.peek()
+	p.pos++
+	return tok
+}
+
+func (p *tagSelectorParser) parseOr() (tagExpr, error) {
+	expr, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	exprs := orExpr{expr}
+	for p.peek().keyword("or") {
+		p.next()
+		expr, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *tagSelectorParser) parseAnd() (tagExpr, error) {
+	expr, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	exprs := andExpr{expr}
+	for p.peek().keyword("and") {
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		exprs = append(exprs, expr)
+	}
+	if len(exprs) == 1 {
+		return exprs[0], nil
+	}
+	return exprs, nil
+}
+
+func (p *tagSelectorParser) parseUnary() (tagExpr, error) {
+	tok := p.peek()
+	switch {
+	case tok.keyword("not") || tok.operator("!"):
+		p.next()
+		expr, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{expr}, nil
+	case tok.operator("("):
+		p.next()
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if !p.next().operator(")") {
+			return nil, fmt.Errorf("missing closing parenthesis in tag selector")
+		}
+		return expr, nil
+	}
+	return p.parseTerm()
+}
+
+func (p *tagSelectorParser) parseTerm() (tagExpr, error) {
+	keyTok := p.next()
+	if keyTok.kind != tokenWord && keyTok.kind != tokenString {
+		return nil, fmt.Errorf("expected tag name in tag selector, got %q", keyTok.value)
+	}
+	key := keyTok.value
+
+	op := p.peek()
+	switch {
+	case op.operator("=") || op.operator("=="):
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return valuesExpr{key, []string{value}}, nil
+	case op.operator("!="):
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{valuesExpr{key, []string{value}}}, nil
+	case op.operator("=~") || op.operator("!~"):
+		p.next()
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		re, err := regexp.Compile("^(?:" + value + ")$")
+		if err != nil {
+			return nil, err
+		}
+		if op.value == "!~" {
+			return notExpr{regexExpr{key, re}}, nil
+		}
+		return regexExpr{key, re}, nil
+	case op.keyword("in") || op.keyword("notin"):
+		p.next()
+		values, err := p.parseValueList()
+		if err != nil {
+			return nil, err
+		}
+		if op.keyword("notin") {
+			return notExpr{valuesExpr{key, values}}, nil
+		}
+		return valuesExpr{key, values}, nil
+	}
+	return existsExpr{key}, nil
+}
+
+func (p *tagSelectorParser) parseValue() (string, error) {
+	tok := p.next()
+	if tok.kind != tokenWord && tok.kind != tokenString {
+		return "", fmt.Errorf("expected tag value in tag selector, got %q", tok.value)
+	}
+	return tok.value, nil
+}
+
+func (p *tagSelectorParser) parseValueList() ([]string, error) {
+	if !p.next().operator("(") {
+		return nil, fmt.Errorf("expected ( after in in tag selector")
+	}
+	var values []string
+	for {
+		value, err := p.parseValue()
+		if err != nil {
+			return nil, err
+		}
+		values = append(values, value)
+
+		tok := p.next()
+		if tok.operator(")") {
+			return values, nil
+		}
+		if !tok.operator(",") {
+			return nil, fmt.Errorf("expected , or ) in tag selector value list, got %q", tok.value)
+		}
+	}
+}
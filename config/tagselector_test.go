@@ -0,0 +1,84 @@
+package config
+
+import (
+	"testing"
+
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestTagSelectorMatches(t *testing.T) {
+	tags := map[string]string{"env": "prod", "Team": "payments", "owner": "alice"}
+
+	var cases = []struct {
+		selector string
+		want     bool
+	}{
+		{"env=prod", true},
+		{"env==prod", true},
+		{"env=staging", false},
+		{"env!=staging", true},
+		{"team=payments", true},
+		{"env in (prod, staging)", true},
+		{"env in (dev, staging)", false},
+		{"env notin (dev, staging)", true},
+		{"owner", true},
+		{"monitoring", false},
+		{"!monitoring", true},
+		{"NOT monitoring=off", true},
+		{"monitoring!=off", true},
+		{"env=~'pro.*'", true},
+		{"env!~'pro.*'", false},
+		{"env=~pr", false},
+		{"env in (prod, staging) AND team=payments AND NOT monitoring=off", true},
+		{"env in (prod, staging) and team=billing", false},
+		{"team=billing OR env=prod", true},
+		{"(team=billing OR env=dev) AND owner", false},
+		{"team=billing OR env=dev AND owner", false},
+		{"owner = \"alice\"", true},
+	}
+
+	for _, c := range cases {
+		selector, err := ParseTagSelector(c.selector)
+		if err != nil {
+			t.Errorf("unexpected error parsing %q: %v", c.selector, err)
+			continue
+		}
+		if got := selector.Matches(tags); got != c.want {
+			t.Errorf("unexpected match for %q\ngot: %v\nwant: %v", c.selector, got, c.want)
+		}
+	}
+}
+
+func TestTagSelectorInvalid(t *testing.T) {
+	var cases = []string{
+		"",
+		"env=",
+		"env in prod",
+		"env in (prod",
+		"(env=prod",
+		"env=prod)",
+		"env=prod AND",
+		"env='prod",
+		"env=~'('",
+	}
+
+	for _, c := range cases {
+		if _, err := ParseTagSelector(c); err == nil {
+			t.Errorf("expected error parsing %q", c)
+		}
+	}
+}
+
+func TestTagSelectorUnmarshalYAML(t *testing.T) {
+	var rt ResourceTag
+	err := yaml.Unmarshal([]byte(`resource_tag_selector: "env in (prod, staging) AND NOT monitoring=off"`), &rt)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if rt.ResourceTagSelector.IsEmpty() {
+		t.Fatalf("resource_tag_selector not parsed")
+	}
+	if !rt.ResourceTagSelector.Matches(map[string]string{"env": "staging"}) {
+		t.Errorf("parsed selector doesn't match")
+	}
+}
@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// counterRetention is how long the counter of a series that is no longer returned is kept.
+var counterRetention = 24 * time.Hour
+
+// totalCounter is the running sum of the Total of the time buckets of a series.
+type totalCounter struct {
+	Value float64 `json:"value"`
+	// Last is the time of the latest bucket added to the counter, older buckets are not added again.
+	Last time.Time `json:"last"`
+}
+
+// totalCounters accumulates the per-interval Total values of each series into monotonic counters,
+// so that each time bucket is counted once even when query windows overlap.
+type totalCounters struct {
+	sync.Mutex
+	counters map[string]*totalCounter
+}
+
+func newTotalCounters() *totalCounters {
+	return &totalCounters{counters: make(map[string]*totalCounter)}
+}
+
+var counters = newTotalCounters()
+
+// counterKey identifies the series of an Azure metric of a resource.
+func counterKey(rm resourceMeta, metric string) string {
+	return resourceKey(rm) + "|" + metric
+}
+
+// add adds the Total of the buckets newer than the latest bucket already counted, and returns the counter value.
+// The trailing buckets without data are left for a later scrape, so that they are counted once Azure fills them,
+// while buckets without data followed by filled ones are gaps of the metric and are skipped.
+func (tc *totalCounters) add(key string, data []AzureMetricData) (float64, error) {
+	tc.Lock()
+	defer tc.Unlock()
+
+	counter, ok := tc.counters[key]
+	if !ok {
+		counter = &totalCounter{}
+		tc.counters[key] = counter
+	}
+
+	filled := len(data)
+	for filled > 0 && data[filled-1].Total == nil {
+		filled--
+	}
+
+	for _, d := range data[:filled] {
+		t, err := time.Parse(time.RFC3339, d.TimeStamp)
+		if err != nil {
+			return counter.Value, fmt.Errorf("Invalid time stamp %q: %v", d.TimeStamp, err)
+		}
+		if !t.After(counter.Last) {
+			continue
+		}
+		if d.Total != nil {
+			counter.Value += *d.Total
+		}
+		counter.Last = t
+	}
+	return counter.Value, nil
+}
+
+// load reads the counters saved to a state file. A missing file is not an error.
+func (tc *totalCounters) load(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Error reading counter state file: %v", err)
+	}
+
+	loaded := make(map[string]*totalCounter)
+	if err := json.Unmarshal(data, &loaded); err != nil {
+		return fmt.Errorf("Error parsing counter state file: %v", err)
+	}
+
+	tc.Lock()
+	tc.counters = loaded
+	tc.Unlock()
+	return nil
+}
+
+// prune drops the counters not updated for counterRetention.
+func (tc *totalCounters) prune(now time.Time) {
+	tc.Lock()
+	defer tc.Unlock()
+	for key, counter := range tc.counters {
+		if now.Sub(counter.Last) > counterRetention {
+			delete(tc.counters, key)
+		}
+	}
+}
+
+// save writes the counters to a state file, dropping the ones not updated for counterRetention.
+func (tc *totalCounters) save(path string) error {
+	tc.prune(time.Now())
+
+	tc.Lock()
+	data, err := json.Marshal(tc.counters)
+	tc.Unlock()
+	if err != nil {
+		return fmt.Errorf("Error encoding counters: %v", err)
+	}
+
+	// Write to a temporary file first so that a crash doesn't leave a truncated state file.
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path))
+	if err != nil {
+		return fmt.Errorf("Error writing counter state file: %v", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Error writing counter state file: %v", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Error writing counter state file: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Error writing counter state file: %v", err)
+	}
+	return nil
+}
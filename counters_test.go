@@ -0,0 +1,134 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func float64Ptr(v float64) *float64 {
+	return &v
+}
+
+func TestTotalCountersAdd(t *testing.T) {
+	tc := newTotalCounters()
+	bucket := func(minutes int, total float64) AzureMetricData {
+		ts := time.Date(2020, 1, 1, 12, minutes, 0, 0, time.UTC)
+		return AzureMetricData{TimeStamp: ts.Format(time.RFC3339), Total: float64Ptr(total)}
+	}
+	empty := func(minutes int) AzureMetricData {
+		ts := time.Date(2020, 1, 1, 12, minutes, 0, 0, time.UTC)
+		return AzureMetricData{TimeStamp: ts.Format(time.RFC3339)}
+	}
+
+	var cases = []struct {
+		data []AzureMetricData
+		want float64
+	}{
+		{[]AzureMetricData{bucket(0, 5), bucket(1, 3)}, 8},
+		// overlapping window, only the new bucket is added
+		{[]AzureMetricData{bucket(0, 5), bucket(1, 3), bucket(2, 4)}, 12},
+		// nothing new
+		{[]AzureMetricData{bucket(1, 3), bucket(2, 4)}, 12},
+		{[]AzureMetricData{bucket(2, 4), bucket(3, 0), bucket(4, 1)}, 13},
+		// trailing bucket without data yet
+		{[]AzureMetricData{bucket(4, 1), empty(5)}, 13},
+		// the bucket is counted once filled
+		{[]AzureMetricData{bucket(4, 1), bucket(5, 2), empty(6)}, 15},
+		// gaps followed by data are skipped
+		{[]AzureMetricData{bucket(5, 2), empty(6), empty(7), bucket(8, 3)}, 18},
+		{[]AzureMetricData{empty(7), bucket(8, 3), bucket(9, 1)}, 19},
+	}
+
+	for i, c := range cases {
+		got, err := tc.add("vm|Network In Total", c.data)
+		if err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		if got != c.want {
+			t.Errorf("doesn't count time buckets once in window %d\ngot: %v\nwant: %v", i, got, c.want)
+		}
+	}
+
+	if got, _ := tc.add("vm|Network Out Total", []AzureMetricData{bucket(4, 2)}); got != 2 {
+		t.Errorf("doesn't count series separately\ngot: %v\nwant: %v", got, 2)
+	}
+	if _, err := tc.add("vm|Network Out Total", []AzureMetricData{{TimeStamp: "yesterday", Total: float64Ptr(1)}}); err == nil {
+		t.Errorf("expected error for invalid time stamp")
+	}
+}
+
+func TestTotalCountersPrune(t *testing.T) {
+	now := time.Now().UTC().Truncate(time.Minute)
+	tc := newTotalCounters()
+	tc.add("recent", []AzureMetricData{{TimeStamp: now.Format(time.RFC3339), Total: float64Ptr(7)}})
+	tc.add("stale", []AzureMetricData{{TimeStamp: now.Add(-48 * time.Hour).Format(time.RFC3339), Total: float64Ptr(1)}})
+
+	tc.prune(now)
+	if _, ok := tc.counters["stale"]; ok || len(tc.counters) != 1 {
+		t.Errorf("doesn't drop stale counters\ngot: %v", tc.counters)
+	}
+}
+
+func TestTotalCountersState(t *testing.T) {
+	dir, err := ioutil.TempDir("", "counters")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "counters.json")
+
+	now := time.Now().UTC().Truncate(time.Minute)
+	tc := newTotalCounters()
+	tc.add("recent", []AzureMetricData{{TimeStamp: now.Format(time.RFC3339), Total: float64Ptr(7)}})
+	tc.add("stale", []AzureMetricData{{TimeStamp: now.Add(-48 * time.Hour).Format(time.RFC3339), Total: float64Ptr(1)}})
+	if err := tc.save(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	loaded := newTotalCounters()
+	if err := loaded.load(path); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(loaded.counters) != 1 {
+		t.Errorf("doesn't drop stale counters\ngot: %v", loaded.counters)
+	}
+	got, _ := loaded.add("recent", []AzureMetricData{
+		{TimeStamp: now.Format(time.RFC3339), Total: float64Ptr(7)},
+		{TimeStamp: now.Add(time.Minute).Format(time.RFC3339), Total: float64Ptr(1)},
+	})
+	if got != 8 {
+		t.Errorf("doesn't restore counters\ngot: %v\nwant: %v", got, 8)
+	}
+
+	if err := newTotalCounters().load(filepath.Join(dir, "missing.json")); err != nil {
+		t.Errorf("unexpected error loading missing state file: %v", err)
+	}
+}
+
+func TestCounterSeries(t *testing.T) {
+	labels := map[string]string{"resource_name": "vm"}
+	var cases = []struct {
+		naming config.MetricNaming
+		want   string
+	}{
+		{config.MetricNaming{}, "network_in_total_bytes_total"},
+		{config.MetricNaming{Suffixes: map[string]string{"Total": "_sum"}}, "network_in_total_bytes_sum"},
+		{config.MetricNaming{Mode: config.NamingLabel}, "network_in_total_bytes_total"},
+	}
+
+	for _, c := range cases {
+		sc.C = &config.Config{MetricNaming: c.naming}
+		got := counterSeries("network_in_total_bytes", "Network In", labels, 3)
+		if got.name != c.want || got.valueType != prometheus.CounterValue || !reflect.DeepEqual(got.labels, labels) {
+			t.Errorf("doesn't build counter series with %+v\ngot: %+v\nwant name: %v", c.naming, got, c.want)
+		}
+	}
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// metricDefinitionsTTL is how long the metric definitions of a resource type are cached.
+var metricDefinitionsTTL = time.Hour
+
+type definitionsKey struct {
+	resourceType    string
+	metricNamespace string
+}
+
+func definitionsKeyFor(resourceType string, metricNamespace string) definitionsKey {
+	return definitionsKey{strings.ToLower(resourceType), strings.ToLower(metricNamespace)}
+}
+
+type cachedDefinitions struct {
+	// definitions holds the definitions by lowercase metric name.
+	definitions map[string]metricDefinitionResponse
+	expires     time.Time
+}
+
+// metricDefinitionCache caches the metric definitions of each resource type and metric namespace,
+// as all resources of a type share the same definitions.
+type metricDefinitionCache struct {
+	sync.Mutex
+	entries map[definitionsKey]cachedDefinitions
+}
+
+func newMetricDefinitionCache() *metricDefinitionCache {
+	return &metricDefinitionCache{entries: make(map[definitionsKey]cachedDefinitions)}
+}
+
+// lookup returns the cached definition of a metric.
+func (c *metricDefinitionCache) lookup(resourceType string, metricNamespace string, metric string) (metricDefinitionResponse, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[definitionsKeyFor(resourceType, metricNamespace)]
+	if !ok {
+		return metricDefinitionResponse{}, false
+	}
+	def, ok := entry.definitions[strings.ToLower(metric)]
+	return def, ok
+}
+
+// all returns the cached definitions of a resource type, sorted by metric name.
+func (c *metricDefinitionCache) all(resourceType string, metricNamespace string) ([]metricDefinitionResponse, bool) {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[definitionsKeyFor(resourceType, metricNamespace)]
+	if !ok {
+		return nil, false
+	}
+	var names []string
+	for name := range entry.definitions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	definitions := make([]metricDefinitionResponse, 0, len(names))
+	for _, name := range names {
+		definitions = append(definitions, entry.definitions[name])
+	}
+	return definitions, true
+}
+
+// missing reports whether the definitions of a resource type must be (re)fetched.
+func (c *metricDefinitionCache) missing(key definitionsKey, now time.Time) bool {
+	c.Lock()
+	defer c.Unlock()
+	entry, ok := c.entries[key]
+	return !ok || now.After(entry.expires)
+}
+
+func (c *metricDefinitionCache) store(key definitionsKey, definitions []metricDefinitionResponse, now time.Time) {
+	entry := cachedDefinitions{
+		definitions: make(map[string]metricDefinitionResponse),
+		expires:     now.Add(metricDefinitionsTTL),
+	}
+	for _, def := range definitions {
+		entry.definitions[strings.ToLower(def.Name.Value)] = def
+	}
+	c.Lock()
+	c.entries[key] = entry
+	c.Unlock()
+}
+
+// batchLookupMetricDefinitions fetches the metric definitions of the resource types and metric namespaces
+// of the resources which are not cached yet, from one resource of each.
+func (ac *AzureClient) batchLookupMetricDefinitions(resources []resourceMeta) error {
+	now := time.Now()
+	var keys []definitionsKey
+	var urls []string
+	seen := make(map[definitionsKey]bool)
+	for _, r := range resources {
+		key := definitionsKeyFor(GetResourceType(r.resourceURL), r.metricNamespace)
+		if key.resourceType == "" || seen[key] || !ac.definitions.missing(key, now) {
+			continue
+		}
+		seen[key] = true
+
+		target := fmt.Sprintf("%s/providers/microsoft.insights/metricDefinitions?api-version=2018-01-01", fullResourceID(r.resourceID))
+		if r.metricNamespace != "" {
+			target = fmt.Sprintf("%s&metricnamespace=%s", target, url.QueryEscape(r.metricNamespace))
+		}
+		keys = append(keys, key)
+		urls = append(urls, target)
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+
+	responses, err := ac.getBatchResponses(urls)
+	if err != nil {
+		return err
+	}
+
+	for i, key := range keys {
+		resp, ok := responses[i]
+		if !ok {
+			log.Printf("No batch response received for metric definitions of %s", urls[i])
+			continue
+		}
+		if resp.HttpStatusCode != 200 {
+			log.Printf("Received %d status looking up metric definitions of %s", resp.HttpStatusCode, urls[i])
+			continue
+		}
+
+		var def AzureMetricDefinitionResponse
+		if err := json.Unmarshal(resp.Content, &def); err != nil {
+			log.Printf("Error unmarshalling metric definitions of %s: %v", urls[i], err)
+			continue
+		}
+		ac.definitions.store(key, def.MetricDefinitionResponses, now)
+	}
+	return nil
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestBatchLookupMetricDefinitions(t *testing.T) {
+	var requested []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch batchBody
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+
+		var responses []map[string]interface{}
+		for _, req := range batch.Requests {
+			requested = append(requested, req.RelativeURL)
+			responses = append(responses, map[string]interface{}{
+				"name":           req.Name,
+				"httpStatusCode": 200,
+				"content": map[string]interface{}{"value": []map[string]interface{}{{
+					"name":                   map[string]string{"value": "Percentage CPU", "localizedValue": "Percentage CPU"},
+					"displayDescription":     "The percentage of allocated compute units in use",
+					"primaryAggregationType": "Average",
+					"unit":                   "Percent",
+				}}},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+	ac.definitions = newMetricDefinitionCache()
+
+	var resources []resourceMeta
+	for _, id := range []string{
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-01",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-02",
+	} {
+		resources = append(resources, resourceMeta{
+			resourceID:  id,
+			resourceURL: resourceURLFrom(id, "", "Percentage CPU", nil),
+		})
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := ac.batchLookupMetricDefinitions(resources); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+	}
+	if len(requested) != 1 || !strings.Contains(requested[0], "vm-01/providers/microsoft.insights/metricDefinitions") {
+		t.Errorf("doesn't look up definitions once per resource type\ngot: %v", requested)
+	}
+
+	def, ok := ac.definitions.lookup("microsoft.compute/virtualMachines", "", "percentage cpu")
+	if !ok || def.PrimaryAggregationType != "Average" {
+		t.Errorf("doesn't cache definitions\ngot: %+v", def)
+	}
+
+	got := metricHelp(resources[1], "Percentage CPU", "Percent")
+	if got != "The percentage of allocated compute units in use" {
+		t.Errorf("doesn't use definition as help\ngot: %v", got)
+	}
+	got = metricHelp(resources[1], "Disk Read Bytes", "Bytes")
+	if got != "Azure metric Disk Read Bytes in Bytes" {
+		t.Errorf("doesn't fall back to metric name as help\ngot: %v", got)
+	}
+}
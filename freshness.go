@@ -0,0 +1,114 @@
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// emptyResponse counts the queries of a metric of a resource which returned no data.
+type emptyResponse struct {
+	labels map[string]string
+	value  float64
+	last   time.Time
+}
+
+// emptyResponseCounters holds the empty response counters of each metric of each resource across scrapes.
+type emptyResponseCounters struct {
+	sync.Mutex
+	counters map[string]*emptyResponse
+}
+
+func newEmptyResponseCounters() *emptyResponseCounters {
+	return &emptyResponseCounters{counters: make(map[string]*emptyResponse)}
+}
+
+var emptyResponses = newEmptyResponseCounters()
+
+// inc counts an empty response for a metric of a resource, under the labels of its rollup groups
+// if it is rolled up.
+func (e *emptyResponseCounters) inc(rm resourceMeta, metric string, now time.Time) {
+	if len(rm.options.Rollups) == 0 {
+		labels := CreateMetricLabels(rm)
+		labels["metric"] = metric
+		e.incLabels(counterKey(rm, metric), labels, now)
+		return
+	}
+	for _, r := range rm.options.Rollups {
+		labels := rollupLabels(rm, r.By)
+		labels["metric"] = metric
+		labelSet := model.LabelSet{}
+		for k, v := range labels {
+			labelSet[model.LabelName(k)] = model.LabelValue(v)
+		}
+		e.incLabels("rollup|"+labelSet.Fingerprint().String(), labels, now)
+	}
+}
+
+func (e *emptyResponseCounters) incLabels(key string, labels map[string]string, now time.Time) {
+	e.Lock()
+	defer e.Unlock()
+	counter, ok := e.counters[key]
+	if !ok {
+		counter = &emptyResponse{}
+		e.counters[key] = counter
+	}
+	counter.labels = labels
+	counter.value++
+	counter.last = now
+}
+
+// series returns the counters, dropping the ones not incremented for counterRetention.
+func (e *emptyResponseCounters) series(now time.Time) []series {
+	e.Lock()
+	defer e.Unlock()
+
+	var keys []string
+	for key, counter := range e.counters {
+		if now.Sub(counter.last) > counterRetention {
+			delete(e.counters, key)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var s []series
+	for _, key := range keys {
+		s = append(s, series{
+			name:      "azure_metric_empty_responses_total",
+			help:      "Number of queries of an Azure metric of a resource which returned no data",
+			labels:    e.counters[key].labels,
+			value:     e.counters[key].value,
+			valueType: prometheus.CounterValue,
+		})
+	}
+	return s
+}
+
+// freshnessSeries builds the series telling how recent the latest sample of a metric of a resource is:
+// the timestamp of the sample, then the delay until the scrape.
+func freshnessSeries(resourceLabels map[string]string, metric string, sampleTime time.Time, now time.Time) []series {
+	labels := make(map[string]string, len(resourceLabels)+1)
+	for k, v := range resourceLabels {
+		labels[k] = v
+	}
+	labels["metric"] = metric
+	return []series{
+		{
+			name:   "azure_metric_last_sample_timestamp_seconds",
+			help:   "Timestamp of the latest sample returned by Azure for a metric of a resource",
+			labels: labels,
+			value:  float64(sampleTime.UnixNano()) / 1e9,
+		},
+		{
+			name:   "azure_metric_ingestion_delay_seconds",
+			help:   "Time between the latest sample returned by Azure for a metric of a resource and the scrape",
+			labels: labels,
+			value:  now.Sub(sampleTime).Seconds(),
+		},
+	}
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestExtractMetricsFreshness(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	emptyResponses = newEmptyResponseCounters()
+	vm := "/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01"
+	q := newMetricQuery([]config.Metric{{Name: "Percentage CPU"}, {Name: "Network In Total"}}, []string{"Average"}, nil, nil)
+	rm := resourceMeta{resourceID: vm, metrics: q.metrics, aggregations: q.aggregations, metricOptions: q.options}
+	rm.resourceURL = resourceURLFrom(vm, "", rm.metrics, rm.aggregations)
+
+	var data AzureMetricValueResponse
+	err := json.Unmarshal([]byte(`{"value": [
+		{"name": {"value": "Percentage CPU"}, "unit": "Percent", "timeseries": [{"data": [
+			{"timeStamp": "2020-01-01T12:00:00Z", "average": 1},
+			{"timeStamp": "2020-01-01T12:01:00Z", "average": 2}
+		]}]},
+		{"name": {"value": "Network In Total"}, "unit": "Bytes", "timeseries": []}
+	]}`), &data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	w := newSeriesWriter(ch, nil)
+	(&Collector{}).extractMetrics(w, newRollupSet(), rm, 200, data)
+	(&Collector{}).extractMetrics(w, newRollupSet(), rm, 200, AzureMetricValueResponse{})
+	for _, s := range emptyResponses.series(time.Now()) {
+		w.write(s)
+	}
+	close(ch)
+
+	got := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		desc := m.Desc().String()
+		name := desc[strings.Index(desc, `fqName: "`)+9 : strings.Index(desc, `", help`)]
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "metric" {
+				name += "{" + l.GetValue() + "}"
+			}
+		}
+		switch {
+		case pb.GetCounter() != nil:
+			got[name] = pb.GetCounter().GetValue()
+		case name == "azure_metric_ingestion_delay_seconds{Percentage CPU}":
+			if pb.GetGauge().GetValue() <= 0 {
+				t.Errorf("doesn't export the ingestion delay\ngot: %v", pb.GetGauge().GetValue())
+			}
+		default:
+			got[name] = pb.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{
+		"percentage_cpu_percent_average":                             2,
+		"azure_metric_last_sample_timestamp_seconds{Percentage CPU}": 1577880060,
+		"azure_metric_empty_responses_total{Network In Total}":       2,
+		"azure_metric_empty_responses_total{Percentage CPU}":         1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't export data freshness\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestEmptyResponsesRollups(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	emptyResponses = newEmptyResponseCounters()
+	for _, app := range []struct{ name, team string }{{"app-1", "web"}, {"app-2", "web"}, {"app-3", "api"}} {
+		id := "/resourceGroups/rg/providers/Microsoft.Web/sites/" + app.name
+		rm := resourceMeta{resourceID: id, resource: AzureResource{ID: id, Tags: map[string]string{"team": app.team}}}
+		rm.options.Rollups = []config.Rollup{{By: []string{"tag_team"}}}
+		emptyResponses.inc(rm, "Requests", time.Now())
+	}
+
+	got := map[string]float64{}
+	for _, s := range emptyResponses.series(time.Now()) {
+		if len(s.labels) != 2 {
+			t.Errorf("doesn't count empty responses under the rollup labels\ngot: %v", s.labels)
+		}
+		got[s.labels["tag_team"]+"|"+s.labels["metric"]] = s.value
+	}
+	want := map[string]float64{"web|Requests": 2, "api|Requests": 1}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't roll up empty responses\ngot: %v\nwant: %v", got, want)
+	}
+}
@@ -7,7 +7,7 @@ require (
 	github.com/golang/protobuf v1.3.3-0.20190827175835-822fe56949f5 // indirect
 	github.com/matttproud/golang_protobuf_extensions v1.0.2-0.20181231171920-c182affec369 // indirect
 	github.com/prometheus/client_golang v1.1.1-0.20190913103102-20428fa0bffc
-	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4 // indirect
+	github.com/prometheus/client_model v0.0.0-20190812154241-14fe0d1b01d4
 	github.com/prometheus/common v0.7.0
 	github.com/prometheus/procfs v0.0.6-0.20190917143953-de25ac347ef9 // indirect
 	golang.org/x/sys v0.0.0-20190919044723-0c1ff786ef13 // indirect
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+type inventoryKey struct {
+	subscription  string
+	resourceGroup string
+	resourceType  string
+	location      string
+}
+
+// inventoryKeyOf returns the labels a resource is counted by.
+func inventoryKeyOf(rm resourceMeta) inventoryKey {
+	key := inventoryKey{
+		subscription:  rm.resource.Subscription,
+		resourceGroup: resourceGroupFrom(fullResourceID(rm.resourceID)),
+		resourceType:  rm.resource.Type,
+		location:      rm.resource.Location,
+	}
+	if key.subscription == "" {
+		key.subscription = subscriptionFrom(rm.resourceID)
+	}
+	if key.resourceType == "" {
+		key.resourceType = GetResourceType(rm.resourceURL)
+	}
+	return key
+}
+
+// writeInventory exports an info series and the creation time of every discovered resource, whether or not
+// its metrics are queried, and the number of resources by subscription, resource group, type and location.
+// Rolled up resources are only counted, so that they don't export per resource series.
+func writeInventory(w *seriesWriter, resources []resourceMeta) {
+	counts := make(map[inventoryKey]int)
+	seen := make(map[string]bool)
+	for _, rm := range resources {
+		// The same resource is listed once per metric namespace.
+		id := strings.ToLower(fullResourceID(rm.resourceID))
+		if seen[id] {
+			continue
+		}
+		seen[id] = true
+		counts[inventoryKeyOf(rm)]++
+		if len(rm.options.Rollups) > 0 {
+			continue
+		}
+
+		w.write(series{
+			name:   "azure_resource_info",
+			help:   "Azure information available for resource",
+			labels: CreateAllResourceLabelsFrom(rm),
+			value:  1,
+		})
+
+		if created, err := time.Parse(time.RFC3339, rm.resource.CreatedTime); err == nil {
+			w.write(series{
+				name:   "azure_resource_created_timestamp_seconds",
+				help:   "Time the Azure resource was created",
+				labels: CreateMetricLabels(rm),
+				value:  float64(created.UnixNano()) / 1e9,
+			})
+		}
+	}
+
+	var keys []inventoryKey
+	for key := range counts {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		a, b := keys[i], keys[j]
+		if a.subscription != b.subscription {
+			return a.subscription < b.subscription
+		}
+		if a.resourceGroup != b.resourceGroup {
+			return a.resourceGroup < b.resourceGroup
+		}
+		if a.resourceType != b.resourceType {
+			return a.resourceType < b.resourceType
+		}
+		return a.location < b.location
+	})
+
+	for _, key := range keys {
+		w.write(series{
+			name: "azure_resources",
+			help: "Number of Azure resources discovered",
+			labels: map[string]string{
+				"subscription":   key.subscription,
+				"resource_group": key.resourceGroup,
+				"type":           key.resourceType,
+				"location":       key.location,
+			},
+			value: float64(counts[key]),
+		})
+	}
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestWriteInventory(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	resource := func(rg string, name string, location string, created string, namespace string) resourceMeta {
+		id := "/subscriptions/" + testSubscriptionID + "/resourceGroups/" + rg + "/providers/Microsoft.Compute/virtualMachines/" + name
+		return resourceMeta{
+			resourceID:      id,
+			resourceURL:     resourceURLFrom(id, namespace, "", nil),
+			metricNamespace: namespace,
+			resource: AzureResource{
+				ID:           id,
+				Name:         name,
+				Location:     location,
+				Type:         "Microsoft.Compute/virtualMachines",
+				Subscription: testSubscriptionID,
+				CreatedTime:  created,
+			},
+		}
+	}
+	resources := []resourceMeta{
+		resource("rg-1", "vm-1", "westeurope", "2020-01-01T12:00:00.1234567Z", ""),
+		resource("rg-1", "vm-1", "westeurope", "2020-01-01T12:00:00.1234567Z", "Azure.VM.Windows.GuestMetrics"),
+		resource("rg-1", "vm-2", "westeurope", "", ""),
+		resource("rg-2", "vm-3", "northeurope", "", ""),
+		// rolled up resources are only counted
+		resource("rg-2", "vm-4", "northeurope", "2020-01-01T12:00:00Z", ""),
+	}
+	resources[4].options.Rollups = []config.Rollup{{By: []string{"location"}}}
+
+	ch := make(chan prometheus.Metric, 20)
+	writeInventory(newSeriesWriter(ch, nil), resources)
+	close(ch)
+
+	got := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		desc := m.Desc().String()
+		name := desc[strings.Index(desc, `fqName: "`)+9 : strings.Index(desc, `", help`)]
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		switch name {
+		case "azure_resources":
+			got[name+"{"+labels["resource_group"]+","+labels["location"]+","+labels["type"]+"}"] = pb.GetGauge().GetValue()
+			if labels["subscription"] != testSubscriptionID {
+				t.Errorf("doesn't label counts with the subscription\ngot: %v", labels)
+			}
+		default:
+			got[name+"{"+labels["resource_name"]+"}"] = pb.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{
+		"azure_resource_info{vm-1}":                                           1,
+		"azure_resource_info{vm-2}":                                           1,
+		"azure_resource_info{vm-3}":                                           1,
+		"azure_resource_created_timestamp_seconds{vm-1}":                      1577880000.1234567,
+		"azure_resources{rg-1,westeurope,Microsoft.Compute/virtualMachines}":  2,
+		"azure_resources{rg-2,northeurope,Microsoft.Compute/virtualMachines}": 2,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't export the inventory\ngot: %v\nwant: %v", got, want)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// bucket is the value of one aggregation of a series over a time bucket.
+type bucket struct {
+	time  time.Time
+	value float64
+}
+
+// exportedBuckets tracks the buckets exported for each series when late data is re-exported, so that
+// buckets Azure revised after they were first exported are exported again with their original timestamp.
+type exportedBuckets struct {
+	sync.Mutex
+	series map[string]map[time.Time]float64
+}
+
+func newExportedBuckets() *exportedBuckets {
+	return &exportedBuckets{series: make(map[string]map[time.Time]float64)}
+}
+
+var lateBuckets = newExportedBuckets()
+
+// next returns the bucket to export for a series among the recent buckets, oldest first: the oldest bucket
+// which was not exported yet or whose value changed, else the latest bucket again. Only one sample per
+// series can be exported per scrape, so revisions of several buckets are exported over several scrapes.
+func (e *exportedBuckets) next(key string, buckets []bucket, lookback time.Duration) (bucket, bool) {
+	if len(buckets) == 0 {
+		return bucket{}, false
+	}
+
+	e.Lock()
+	defer e.Unlock()
+
+	exported, ok := e.series[key]
+	if !ok {
+		exported = make(map[time.Time]float64)
+		e.series[key] = exported
+	}
+
+	// Forget the buckets that are not queried anymore.
+	oldest := buckets[len(buckets)-1].time.Add(-lookback)
+	for t := range exported {
+		if t.Before(oldest) {
+			delete(exported, t)
+		}
+	}
+
+	next := buckets[len(buckets)-1]
+	for _, b := range buckets {
+		if value, ok := exported[b.time]; !ok || value != b.value {
+			next = b
+			break
+		}
+	}
+	exported[next.time] = next.value
+	return next, true
+}
+
+// forget drops the series not seen since the given time.
+func (e *exportedBuckets) forget(before time.Time) {
+	e.Lock()
+	defer e.Unlock()
+	for key, exported := range e.series {
+		latest := time.Time{}
+		for t := range exported {
+			if t.After(latest) {
+				latest = t
+			}
+		}
+		if latest.Before(before) {
+			delete(e.series, key)
+		}
+	}
+}
+
+// bucketsOf returns the values of an aggregation in each time bucket that holds data.
+func bucketsOf(data []AzureMetricData, aggregation string) ([]bucket, error) {
+	var buckets []bucket
+	for _, d := range data {
+		t, err := time.Parse(time.RFC3339, d.TimeStamp)
+		if err != nil {
+			return nil, fmt.Errorf("Invalid time stamp %q: %v", d.TimeStamp, err)
+		}
+		if v, ok := d.value(aggregation); ok {
+			buckets = append(buckets, bucket{t, v})
+		}
+	}
+	return buckets, nil
+}
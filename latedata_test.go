@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestExportedBucketsNext(t *testing.T) {
+	e := newExportedBuckets()
+	at := func(minutes int) time.Time {
+		return time.Date(2020, 1, 1, 12, minutes, 0, 0, time.UTC)
+	}
+
+	var cases = []struct {
+		buckets []bucket
+		want    bucket
+	}{
+		// first scrape, the oldest bucket is exported first
+		{[]bucket{{at(0), 1}, {at(1), 2}}, bucket{at(0), 1}},
+		{[]bucket{{at(0), 1}, {at(1), 2}}, bucket{at(1), 2}},
+		// nothing new, the latest bucket is exported again
+		{[]bucket{{at(0), 1}, {at(1), 2}}, bucket{at(1), 2}},
+		// revised bucket is exported before the new one
+		{[]bucket{{at(0), 1}, {at(1), 5}, {at(2), 3}}, bucket{at(1), 5}},
+		{[]bucket{{at(0), 1}, {at(1), 5}, {at(2), 3}}, bucket{at(2), 3}},
+		// buckets out of the lookback are forgotten
+		{[]bucket{{at(9), 4}, {at(10), 4}}, bucket{at(9), 4}},
+	}
+
+	for i, c := range cases {
+		got, ok := e.next("vm|Percentage CPU|Average", c.buckets, 5*time.Minute)
+		if !ok || got != c.want {
+			t.Errorf("doesn't export bucket %d\ngot: %v\nwant: %v", i, got, c.want)
+		}
+	}
+	if want := map[time.Time]float64{at(9): 4}; !reflect.DeepEqual(e.series["vm|Percentage CPU|Average"], want) {
+		t.Errorf("doesn't forget buckets out of the lookback\ngot: %v\nwant: %v", e.series["vm|Percentage CPU|Average"], want)
+	}
+
+	if _, ok := e.next("empty", nil, 5*time.Minute); ok {
+		t.Errorf("expected no bucket without data")
+	}
+
+	e.forget(at(10))
+	if len(e.series) != 0 {
+		t.Errorf("doesn't forget series not seen recently\ngot: %v", e.series)
+	}
+}
+
+func TestBucketsOf(t *testing.T) {
+	data := []AzureMetricData{
+		{TimeStamp: "2020-01-01T12:00:00Z", Average: float64Ptr(1), Maximum: float64Ptr(2)},
+		{TimeStamp: "2020-01-01T12:01:00Z", Average: float64Ptr(3), Maximum: float64Ptr(4)},
+	}
+	got, err := bucketsOf(data, "Maximum")
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []bucket{
+		{time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC), 2},
+		{time.Date(2020, 1, 1, 12, 1, 0, 0, time.UTC), 4},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't read buckets\ngot: %v\nwant: %v", got, want)
+	}
+
+	if _, err := bucketsOf([]AzureMetricData{{TimeStamp: "yesterday"}}, "Maximum"); err == nil {
+		t.Errorf("expected error for invalid time stamp")
+	}
+}
+
+func TestSeriesWriterTimestamp(t *testing.T) {
+	ch := make(chan prometheus.Metric, 1)
+	w := newSeriesWriter(ch, nil)
+	ts := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	w.write(series{name: "cpu_average", help: "cpu", value: 1, timestamp: ts})
+	close(ch)
+
+	var pb dto.Metric
+	(<-ch).Write(&pb)
+	if got, want := pb.GetTimestampMs(), ts.UnixNano()/int64(time.Millisecond); got != want {
+		t.Errorf("doesn't export the bucket timestamp\ngot: %v\nwant: %v", got, want)
+	}
+}
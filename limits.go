@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// globalSelector is the selector label of the global limits.
+const globalSelector = "global"
+
+var limitExceededDesc = prometheus.NewDesc(
+	"azure_exporter_limit_exceeded",
+	"Whether a max_resources or max_series limit truncated the resources or series of a selector during the scrape",
+	[]string{"selector", "limit"}, nil,
+)
+
+// selectorName identifies a selector by its section in the config and its position, e.g. resource_types[0].
+func selectorName(section string, i int) string {
+	return fmt.Sprintf("%s[%d]", section, i)
+}
+
+type limitKey struct {
+	selector string
+	limit    string
+}
+
+// limitReport records the limits checked during a scrape and whether they were exceeded.
+type limitReport struct {
+	checked map[limitKey]bool
+}
+
+func (l *limitReport) report(selector string, limit string, exceeded bool) {
+	if l.checked == nil {
+		l.checked = make(map[limitKey]bool)
+	}
+	key := limitKey{selector, limit}
+	l.checked[key] = l.checked[key] || exceeded
+}
+
+// collect sends one series per limit checked, set to 1 if it was exceeded.
+func (l *limitReport) collect(ch chan<- prometheus.Metric) {
+	var keys []limitKey
+	for key := range l.checked {
+		keys = append(keys, key)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].selector != keys[j].selector {
+			return keys[i].selector < keys[j].selector
+		}
+		return keys[i].limit < keys[j].limit
+	})
+
+	for _, key := range keys {
+		value := 0.0
+		if l.checked[key] {
+			value = 1
+		}
+		ch <- prometheus.MustNewConstMetric(limitExceededDesc, prometheus.GaugeValue, value, key.selector, key.limit)
+	}
+}
+
+// sortedByResource returns the positions of the resources ordered by resource ID, so that
+// the same resources are kept on every scrape when a limit is hit.
+func sortedByResource(resources []resourceMeta) []int {
+	order := make([]int, len(resources))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(i, j int) bool {
+		return resourceKey(resources[order[i]]) < resourceKey(resources[order[j]])
+	})
+	return order
+}
+
+// limitResources keeps at most max resources, the first ones by resource ID.
+func (l *limitReport) limitResources(resources []resourceMeta, selector string, max int) []resourceMeta {
+	if max <= 0 {
+		return resources
+	}
+	l.report(selector, "max_resources", len(resources) > max)
+	if len(resources) <= max {
+		return resources
+	}
+
+	log.Printf("Selector %s matched %d resources, more than its max_resources of %d: dropping %d of them", selector, len(resources), max, len(resources)-max)
+	keep := make(map[int]bool, max)
+	for _, i := range sortedByResource(resources)[:max] {
+		keep[i] = true
+	}
+	var limited []resourceMeta
+	for i, rm := range resources {
+		if keep[i] {
+			limited = append(limited, rm)
+		}
+	}
+	return limited
+}
+
+// limitSelectors applies the max_resources of each selector to the resources it matched, before they are merged.
+func (l *limitReport) limitSelectors(resources []resourceMeta) []resourceMeta {
+	var selectors []string
+	matched := make(map[string][]resourceMeta)
+	for _, rm := range resources {
+		if _, ok := matched[rm.selector]; !ok {
+			selectors = append(selectors, rm.selector)
+		}
+		matched[rm.selector] = append(matched[rm.selector], rm)
+	}
+
+	var limited []resourceMeta
+	for _, selector := range selectors {
+		limited = append(limited, l.limitResources(matched[selector], selector, matched[selector][0].options.MaxResources)...)
+	}
+	return limited
+}
+
+// estimatedSeries is the number of metric series a resource exports, one per metric and aggregation and two
+// per metric baseline. Rolled up resources are not counted as their series are aggregated.
+func estimatedSeries(rm resourceMeta) int {
+	if len(rm.options.Rollups) > 0 {
+		return 0
+	}
+	n := 0
+	for _, name := range strings.Split(rm.metrics, ",") {
+		if name == "" {
+			continue
+		}
+		aggregations := rm.aggregations
+		metric, ok := rm.metricOptions[strings.ToLower(name)]
+		if ok {
+			aggregations = metric.Aggregations
+		}
+		n += len(filterAggregations(aggregations))
+		if metric.Baseline.Enabled {
+			n += 2
+		}
+	}
+	return n
+}
+
+// limitSeries drops the resources, last ones by resource ID first, whose metric series would
+// exceed the max_series of their selector or the global max_series.
+func (l *limitReport) limitSeries(resources []resourceMeta) []resourceMeta {
+	if sc.C.MaxSeries > 0 {
+		l.report(globalSelector, "max_series", false)
+	}
+
+	total := 0
+	perSelector := make(map[string]int)
+	dropped := make(map[string]int)
+	keep := make(map[int]bool, len(resources))
+	for _, i := range sortedByResource(resources) {
+		rm := resources[i]
+		n := estimatedSeries(rm)
+		if max := rm.options.MaxSeries; max > 0 {
+			exceeded := perSelector[rm.selector]+n > max
+			l.report(rm.selector, "max_series", exceeded)
+			if exceeded {
+				dropped[rm.selector]++
+				continue
+			}
+		}
+		if sc.C.MaxSeries > 0 && total+n > sc.C.MaxSeries {
+			l.report(globalSelector, "max_series", true)
+			dropped[globalSelector]++
+			continue
+		}
+		perSelector[rm.selector] += n
+		total += n
+		keep[i] = true
+	}
+
+	for selector, count := range dropped {
+		log.Printf("Selector %s exceeded its max_series: dropping %d resources", selector, count)
+	}
+
+	var limited []resourceMeta
+	for i, rm := range resources {
+		if keep[i] {
+			limited = append(limited, rm)
+		}
+	}
+	return limited
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func limitedNames(resources []resourceMeta) []string {
+	var names []string
+	for _, rm := range resources {
+		names = append(names, rm.resourceID)
+	}
+	return names
+}
+
+func TestLimitResources(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	var resources []resourceMeta
+	for _, name := range []string{"vm-3", "vm-1", "vm-4", "vm-2"} {
+		resources = append(resources, resourceMeta{resourceID: "/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + name})
+	}
+
+	var l limitReport
+	got := limitedNames(l.limitResources(resources, "resource_types[0]", 2))
+	want := []string{
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-1",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-2",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't keep the first resources by ID\ngot: %v\nwant: %v", got, want)
+	}
+	if got := l.limitResources(resources, "resource_types[1]", 4); len(got) != 4 {
+		t.Errorf("drops resources under the limit\ngot: %v", limitedNames(got))
+	}
+	if got := l.limitResources(resources, "resource_types[2]", 0); len(got) != 4 {
+		t.Errorf("drops resources without limit\ngot: %v", limitedNames(got))
+	}
+
+	wantReport := map[limitKey]bool{
+		{"resource_types[0]", "max_resources"}: true,
+		{"resource_types[1]", "max_resources"}: false,
+	}
+	if !reflect.DeepEqual(l.checked, wantReport) {
+		t.Errorf("doesn't report limits\ngot: %v\nwant: %v", l.checked, wantReport)
+	}
+}
+
+func TestLimitSelectors(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	resource := func(selector string, name string, maxResources int) resourceMeta {
+		rm := resourceMeta{selector: selector, resourceID: "/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + name}
+		rm.options.MaxResources = maxResources
+		return rm
+	}
+	resources := []resourceMeta{
+		resource("resource_types[0]", "vm-2", 1),
+		resource("resource_types[0]", "vm-1", 1),
+		resource("resource_tags[0]", "vm-2", 0),
+		resource("resource_tags[0]", "vm-3", 0),
+	}
+
+	var l limitReport
+	got := limitedNames(l.limitSelectors(resources))
+	want := []string{
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-1",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-2",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't limit the resources of each selector\ngot: %v\nwant: %v", got, want)
+	}
+	wantReport := map[limitKey]bool{{"resource_types[0]", "max_resources"}: true}
+	if !reflect.DeepEqual(l.checked, wantReport) {
+		t.Errorf("doesn't report limits\ngot: %v\nwant: %v", l.checked, wantReport)
+	}
+}
+
+func TestLimitSeries(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	sc.C.MaxSeries = 5
+
+	resource := func(selector string, name string, maxSeries int, rollups []config.Rollup) resourceMeta {
+		return resourceMeta{
+			resourceID:   "/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/" + name,
+			metrics:      "Percentage CPU,Network In Total",
+			aggregations: []string{"Average"},
+			metricOptions: map[string]config.Metric{
+				"network in total": {Name: "Network In Total", Aggregations: []string{"Total", "Maximum"}},
+			},
+			options:  config.SelectorOptions{MaxSeries: maxSeries, Rollups: rollups},
+			selector: selector,
+		}
+	}
+	resources := []resourceMeta{
+		resource("resource_types[0]", "vm-2", 3, nil),
+		resource("resource_types[0]", "vm-1", 3, nil),
+		resource("resource_types[1]", "vm-3", 0, []config.Rollup{{By: []string{"resource_group"}}}),
+		resource("resource_types[1]", "vm-4", 0, nil),
+		resource("resource_types[1]", "vm-5", 0, nil),
+	}
+
+	var l limitReport
+	got := limitedNames(l.limitSeries(resources))
+	want := []string{
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-1",
+		"/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm-3",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't limit series\ngot: %v\nwant: %v", got, want)
+	}
+	wantReport := map[limitKey]bool{
+		{"resource_types[0]", "max_series"}: true,
+		{globalSelector, "max_series"}:      true,
+	}
+	if !reflect.DeepEqual(l.checked, wantReport) {
+		t.Errorf("doesn't report limits\ngot: %v\nwant: %v", l.checked, wantReport)
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	l.collect(ch)
+	close(ch)
+	var values []float64
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		values = append(values, pb.GetGauge().GetValue())
+	}
+	if !reflect.DeepEqual(values, []float64{1, 1}) {
+		t.Errorf("doesn't export exceeded limits\ngot: %v", values)
+	}
+}
+
+func TestSeriesWriterMaxSeries(t *testing.T) {
+	ch := make(chan prometheus.Metric, 10)
+	w := newSeriesWriter(ch, nil)
+	w.maxSeries = 3
+	w.selectorMaxSeries["resource_tags[0]"] = 1
+	// Series without selector, e.g. the inventory, are not limited.
+	for _, name := range []string{"azure_resource_info", "azure_resources"} {
+		w.write(series{name: name, help: name, value: 1})
+	}
+	for _, s := range []struct{ name, selector string }{
+		{"a", "resource_tags[0]"}, {"b", "resource_tags[0]"},
+		{"c", "resource_types[0]"}, {"d", "resource_types[0]"}, {"e", "resource_types[0]"},
+	} {
+		w.write(series{name: s.name, help: s.name, value: 1, selector: s.selector})
+	}
+	close(ch)
+
+	var got []string
+	for m := range ch {
+		desc := m.Desc().String()
+		got = append(got, desc[strings.Index(desc, `fqName: "`)+9:strings.Index(desc, `", help`)])
+	}
+	want := []string{"azure_resource_info", "azure_resources", "a", "c", "d"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't limit metric series\ngot: %v\nwant: %v", got, want)
+	}
+	wantExceeded := map[string]bool{"resource_tags[0]": true, globalSelector: true}
+	if !reflect.DeepEqual(w.exceeded, wantExceeded) {
+		t.Errorf("doesn't record exceeded limits\ngot: %v\nwant: %v", w.exceeded, wantExceeded)
+	}
+}
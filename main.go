@@ -6,8 +6,12 @@ import (
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"reflect"
 	"regexp"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/RobustPerception/azure_metrics_exporter/config"
 
@@ -27,9 +31,16 @@ var (
 	listenAddress         = kingpin.Flag("web.listen-address", "The address to listen on for HTTP requests.").Default(":9276").String()
 	listMetricDefinitions = kingpin.Flag("list.definitions", "List available metric definitions for the given resources and exit.").Bool()
 	listMetricNamespaces  = kingpin.Flag("list.namespaces", "List available metric namespaces for the given resources and exit.").Bool()
+	checkMetrics          = kingpin.Flag("config.check-metrics", "Check the configured metrics against the metric definitions of a sample of the resources at startup and on reload.").Bool()
+	strictConfig          = kingpin.Flag("config.strict", "Exit at startup, or keep the previous config on reload, when the metrics check finds a problem instead of logging a warning. Implies --config.check-metrics.").Bool()
 	invalidMetricChars    = regexp.MustCompile("[^a-zA-Z0-9_:]")
 	azureErrorDesc        = prometheus.NewDesc("azure_error", "Error collecting metrics", nil, nil)
+	powerStates           = []string{"running", "stopped", "deallocated", "starting", "stopping", "deallocating", "unknown"}
+	overlappingDesc       = prometheus.NewDesc("azure_overlapping_resources", "Number of resources matched by more than one selector, queried once with their metrics merged", nil, nil)
 	batchSize             = 20
+	batchRetries          = 1
+	// maxMetricsPerQuery is the maximum number of metrics Azure Monitor accepts in one request
+	maxMetricsPerQuery = 20
 )
 
 func init() {
@@ -37,7 +48,10 @@ func init() {
 }
 
 // Collector generic collector type
-type Collector struct{}
+type Collector struct {
+	// limits records the limits checked during the scrape.
+	limits limitReport
+}
 
 // Describe implemented with dummy data to satisfy interface.
 func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
@@ -45,250 +59,1023 @@ func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
 }
 
 type resourceMeta struct {
-	resourceID      string
-	resourceURL     string
-	metricNamespace string
-	metrics         string
-	aggregations    []string
-	resource        AzureResource
+	resourceID         string
+	resourceURL        string
+	metricNamespace    string
+	metrics            string
+	aggregations       []string
+	resource           AzureResource
+	options            config.SelectorOptions
+	parentResourceName string
+	inheritedTags      map[string]string
+	// metricOptions holds the settings of each metric by lowercase name, with their effective aggregations.
+	metricOptions map[string]config.Metric
+	// metricFilters select more metrics from the metric definitions of the resource.
+	metricFilters []metricFilter
+	// selector names the selector which matched the resource, for limits.
+	selector string
+}
+
+// metricFilter selects metrics from the metric definitions of a resource by name, for
+// "metrics: all" and metric_name_include_re / metric_name_exclude_re.
+type metricFilter struct {
+	includeRe []config.Regexp
+	excludeRe []config.Regexp
+	// aggregations are the aggregations of the selector, the primary aggregation
+	// of each metric is used when empty.
+	aggregations []string
+}
+
+// metricQuery holds the metrics of a selector with their aggregations and per-metric settings.
+type metricQuery struct {
+	metrics      string
+	aggregations []string
+	options      map[string]config.Metric
+	filters      []metricFilter
+}
+
+// newMetricQuery resolves the aggregations of each metric, defaulting to the ones of the selector.
+// The query requests the union of the aggregations, while each metric only exports its own.
+func newMetricQuery(metrics config.Metrics, aggregations []string, includeRe []config.Regexp, excludeRe []config.Regexp) metricQuery {
+	q := metricQuery{options: make(map[string]config.Metric)}
+	if metrics.All() || len(includeRe) != 0 || len(excludeRe) != 0 {
+		q.filters = []metricFilter{{includeRe, excludeRe, aggregations}}
+	}
+
+	var names []string
+	for _, metric := range metrics {
+		if metric.Name == "" {
+			continue
+		}
+		names = append(names, metric.Name)
+		if len(metric.Aggregations) == 0 {
+			metric.Aggregations = aggregations
+		}
+		metric.Aggregations = filterAggregations(metric.Aggregations)
+		q.aggregations = mergeNames(q.aggregations, metric.Aggregations)
+		q.options = mergeMetricOptions(q.options, map[string]config.Metric{strings.ToLower(metric.Name): metric})
+	}
+	q.metrics = strings.Join(mergeNames(names, nil), ",")
+	if len(q.aggregations) == 0 {
+		q.aggregations = filterAggregations(aggregations)
+	}
+	return q
+}
+
+// resourceKey identifies a resource queried for a metric namespace. Azure resource IDs are case-insensitive.
+func resourceKey(rm resourceMeta) string {
+	return strings.ToLower(fullResourceID(rm.resourceID) + "|" + rm.metricNamespace)
+}
+
+// mergeResources merges the resources matched by several selectors so that each resource is queried,
+// and each of its series emitted, once. The metrics and aggregations of the overlapping selectors are
+// merged. Returns the merged resources along with the number of resources that overlapped.
+func mergeResources(resources []resourceMeta) ([]resourceMeta, int) {
+	var merged []resourceMeta
+	positions := make(map[string]int)
+	overlaps := make(map[string]int)
+
+	for _, rm := range resources {
+		key := resourceKey(rm)
+		pos, ok := positions[key]
+		if !ok {
+			positions[key] = len(merged)
+			merged = append(merged, rm)
+			continue
+		}
+
+		overlaps[key]++
+		m := &merged[pos]
+		m.metrics = strings.Join(mergeNames(strings.Split(m.metrics, ","), strings.Split(rm.metrics, ",")), ",")
+		m.aggregations = mergeNames(m.aggregations, rm.aggregations)
+		m.metricOptions = mergeMetricOptions(m.metricOptions, rm.metricOptions)
+		m.metricFilters = append(append([]metricFilter{}, m.metricFilters...), rm.metricFilters...)
+		m.resourceURL = resourceURLFrom(m.resourceID, m.metricNamespace, m.metrics, m.aggregations)
+		if m.resource.ID == "" {
+			m.resource = rm.resource
+		}
+		m.options = mergeSelectorOptions(m.options, rm.options, m.resourceID)
+	}
+
+	for key, count := range overlaps {
+		log.Printf("Resource %s matched by %d selectors, querying it once", merged[positions[key]].resourceID, count+1)
+	}
+	return merged, len(overlaps)
+}
+
+// mergeSelectorOptions merges the options of the selectors matching the same resource. State filters are
+// merged as a union, where a selector without filter keeps every state, and labels, tag labels, sub resources
+// and rollups are merged as a union. Options that can't be merged are taken from the first selector, with a log.
+func mergeSelectorOptions(a config.SelectorOptions, b config.SelectorOptions, resourceID string) config.SelectorOptions {
+	merged := a
+	merged.SubResources = append(append([]config.SubResource{}, a.SubResources...), b.SubResources...)
+	merged.ProvisioningStates = mergeStates(a.ProvisioningStates, b.ProvisioningStates)
+	merged.PowerStates = mergeStates(a.PowerStates, b.PowerStates)
+	merged.InheritResourceGroupTags = a.InheritResourceGroupTags || b.InheritResourceGroupTags
+	merged.ExportPowerState = a.ExportPowerState || b.ExportPowerState
+
+	if len(a.TagLabels) > 0 || len(b.TagLabels) > 0 {
+		// An empty list stands for the global tag_labels.
+		tagLabels := func(o config.SelectorOptions) []string {
+			if len(o.TagLabels) > 0 {
+				return o.TagLabels
+			}
+			return sc.C.TagLabels
+		}
+		merged.TagLabels = mergeNames(tagLabels(a), tagLabels(b))
+	}
+
+	merged.Labels = make(map[string]config.Template, len(a.Labels)+len(b.Labels))
+	for name, tmpl := range a.Labels {
+		merged.Labels[name] = tmpl
+	}
+	for name, tmpl := range b.Labels {
+		if existing, ok := merged.Labels[name]; ok {
+			if existing.Tree.Root.String() != tmpl.Tree.Root.String() {
+				log.Printf("Resource %s matched by selectors setting label %s differently, using %q", resourceID, name, existing.Tree.Root.String())
+			}
+			continue
+		}
+		merged.Labels[name] = tmpl
+	}
+
+	if (len(a.Rollups) == 0) != (len(b.Rollups) == 0) {
+		log.Printf("Resource %s matched by selectors with and without rollups, only exporting its rolled up series", resourceID)
+	}
+	merged.Rollups = append([]config.Rollup{}, a.Rollups...)
+	for _, r := range b.Rollups {
+		if !hasRollup(merged.Rollups, r) {
+			merged.Rollups = append(merged.Rollups, r)
+		}
+	}
+
+	if a.MaxSeries != b.MaxSeries {
+		log.Printf("Resource %s matched by selectors with different max_series, counting it against the first one", resourceID)
+	}
+	return merged
+}
+
+// mergeStates merges two state filters, an empty filter keeps every state.
+func mergeStates(a []string, b []string) []string {
+	if len(a) == 0 || len(b) == 0 {
+		return nil
+	}
+	return mergeNames(a, b)
+}
+
+func hasRollup(rollups []config.Rollup, rollup config.Rollup) bool {
+	for _, r := range rollups {
+		if reflect.DeepEqual(r.By, rollup.By) {
+			return true
+		}
+	}
+	return false
+}
+
+// mergeMetricOptions merges the settings of metrics queried by several selectors. The aggregations
+// of a metric are merged, its other settings are taken from the first selector.
+func mergeMetricOptions(a map[string]config.Metric, b map[string]config.Metric) map[string]config.Metric {
+	merged := make(map[string]config.Metric, len(a)+len(b))
+	for name, metric := range a {
+		merged[name] = metric
+	}
+	for name, metric := range b {
+		if m, ok := merged[name]; ok {
+			m.Aggregations = mergeNames(m.Aggregations, metric.Aggregations)
+			metric = m
+		}
+		merged[name] = metric
+	}
+	return merged
+}
+
+// resolveMetrics adds the metrics selected by the metric filters of each resource, from the cached
+// metric definitions of its resource type. Metrics without configured aggregations are queried
+// with their primary aggregation.
+func resolveMetrics(resources []resourceMeta) []resourceMeta {
+	for i := range resources {
+		rm := &resources[i]
+		if len(rm.metricFilters) == 0 {
+			continue
+		}
+
+		resourceType := GetResourceType(rm.resourceURL)
+		definitions, ok := ac.definitions.all(resourceType, rm.metricNamespace)
+		if !ok {
+			log.Printf("No metric definitions found to select metrics of resource %s", rm.resourceID)
+			continue
+		}
+
+		names := strings.Split(rm.metrics, ",")
+		options := make(map[string]config.Metric)
+		for _, def := range definitions {
+			name := def.Name.Value
+			// Metrics listed explicitly keep their own settings.
+			if _, ok := rm.metricOptions[strings.ToLower(name)]; ok {
+				continue
+			}
+			for _, f := range rm.metricFilters {
+				if !matchesFilter(name, f.includeRe, f.excludeRe) {
+					continue
+				}
+				aggregations := f.aggregations
+				if len(aggregations) == 0 && isAggregation(def.PrimaryAggregationType) {
+					aggregations = []string{def.PrimaryAggregationType}
+				}
+				options = mergeMetricOptions(options, map[string]config.Metric{
+					strings.ToLower(name): {Name: name, Aggregations: filterAggregations(aggregations)},
+				})
+				names = append(names, name)
+			}
+		}
+
+		rm.metricOptions = mergeMetricOptions(rm.metricOptions, options)
+		rm.metrics = strings.Join(mergeNames(names, nil), ",")
+		for _, m := range options {
+			rm.aggregations = mergeNames(rm.aggregations, m.Aggregations)
+		}
+	}
+	return resources
+}
+
+// isAggregation reports whether a primary aggregation type is one of the aggregations the exporter queries.
+func isAggregation(aggregation string) bool {
+	for _, a := range filterAggregations(nil) {
+		if a == aggregation {
+			return true
+		}
+	}
+	return false
+}
+
+// planQueries groups the metrics of all resources into the fewest queries: one per resource and
+// metric namespace, with at most maxMetricsPerQuery metrics each. Metrics overriding the metric
+// namespace of their selector are queried along with the other metrics of that namespace.
+func planQueries(resources []resourceMeta) []resourceMeta {
+	var queries []resourceMeta
+	positions := make(map[string]int)
+
+	for _, rm := range resources {
+		for _, name := range strings.Split(rm.metrics, ",") {
+			if name == "" {
+				continue
+			}
+			metric, ok := rm.metricOptions[strings.ToLower(name)]
+			if !ok {
+				metric = config.Metric{Name: name, Aggregations: rm.aggregations}
+			}
+			if metric.MetricNamespace == "" {
+				metric.MetricNamespace = rm.metricNamespace
+			}
+
+			q := rm
+			q.metricNamespace = metric.MetricNamespace
+			key := resourceKey(q)
+			pos, ok := positions[key]
+			if !ok {
+				q.metrics = ""
+				q.aggregations = nil
+				q.metricOptions = map[string]config.Metric{}
+				positions[key] = len(queries)
+				queries = append(queries, q)
+				pos = len(queries) - 1
+			}
+
+			m := &queries[pos]
+			m.metrics = strings.Join(mergeNames(strings.Split(m.metrics, ","), []string{name}), ",")
+			m.aggregations = mergeNames(m.aggregations, metric.Aggregations)
+			m.metricOptions = mergeMetricOptions(m.metricOptions, map[string]config.Metric{strings.ToLower(name): metric})
+		}
+	}
+
+	var planned []resourceMeta
+	for _, q := range queries {
+		names := strings.Split(q.metrics, ",")
+		for i := 0; i < len(names); i += maxMetricsPerQuery {
+			j := i + maxMetricsPerQuery
+			if j > len(names) {
+				j = len(names)
+			}
+			chunk := q
+			chunk.metrics = strings.Join(names[i:j], ",")
+			chunk.resourceURL = resourceURLFrom(chunk.resourceID, chunk.metricNamespace, chunk.metrics, queryAggregations(chunk))
+			planned = append(planned, chunk)
+		}
+	}
+	return planned
 }
 
-func (c *Collector) extractMetrics(ch chan<- prometheus.Metric, rm resourceMeta, httpStatusCode int, metricValueData AzureMetricValueResponse, publishedResources map[string]bool) {
+// queryAggregations returns the aggregations to query for a resource, along with the sample
+// count needed to weight the averages of rollups.
+func queryAggregations(rm resourceMeta) []string {
+	if !queriesCount(rm) {
+		return rm.aggregations
+	}
+	return append(append([]string{}, filterAggregations(rm.aggregations)...), "Count")
+}
+
+// queriesCount returns whether the sample count is queried for a resource, which is when its averages are rolled up.
+func queriesCount(rm resourceMeta) bool {
+	return len(rm.options.Rollups) > 0 && hasAggregation(filterAggregations(rm.aggregations), "Average")
+}
+
+// mergeNames returns the union of a and b, keeping the order of a and comparing names case-insensitively.
+func mergeNames(a []string, b []string) []string {
+	seen := make(map[string]bool)
+	var merged []string
+	for _, name := range append(append([]string{}, a...), b...) {
+		if name == "" || seen[strings.ToLower(name)] {
+			continue
+		}
+		seen[strings.ToLower(name)] = true
+		merged = append(merged, name)
+	}
+	return merged
+}
+
+func (c *Collector) extractMetrics(w *seriesWriter, rollups *rollupSet, rm resourceMeta, httpStatusCode int, metricValueData AzureMetricValueResponse) {
 	if httpStatusCode != 200 {
 		log.Printf("Received %d status for resource %s. %s", httpStatusCode, rm.resourceURL, metricValueData.APIError.Message)
 		return
 	}
 
-	if len(metricValueData.Value) == 0 || len(metricValueData.Value[0].Timeseries) == 0 {
+	now := time.Now()
+	if len(metricValueData.Value) == 0 {
 		log.Printf("Metric %v not found at target %v\n", rm.metrics, rm.resourceURL)
-		return
-	}
-	if len(metricValueData.Value[0].Timeseries[0].Data) == 0 {
-		log.Printf("No metric data returned for metric %v at target %v\n", rm.metrics, rm.resourceURL)
+		for _, metric := range strings.Split(rm.metrics, ",") {
+			emptyResponses.inc(rm, metric, now)
+		}
 		return
 	}
 
 	for _, value := range metricValueData.Value {
-		// Ensure Azure metric names conform to Prometheus metric name conventions
-		metricName := strings.Replace(value.Name.Value, " ", "_", -1)
-		metricName = strings.ToLower(metricName + "_" + value.Unit)
-		metricName = strings.Replace(metricName, "/", "_per_", -1)
-		if rm.metricNamespace != "" {
-			metricName = strings.ToLower(rm.metricNamespace + "_" + metricName)
-		}
-		metricName = invalidMetricChars.ReplaceAllString(metricName, "_")
-
-		if len(value.Timeseries) > 0 {
-			metricValue := value.Timeseries[0].Data[len(value.Timeseries[0].Data)-1]
-			labels := CreateResourceLabels(rm.resourceURL)
-
-			if hasAggregation(rm.aggregations, "Total") {
-				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(metricName+"_total", metricName+"_total", nil, labels),
-					prometheus.GaugeValue,
-					metricValue.Total,
-				)
+		if len(value.Timeseries) == 0 || len(value.Timeseries[0].Data) == 0 {
+			log.Printf("No metric data returned for metric %v at target %v\n", value.Name.Value, rm.resourceURL)
+			emptyResponses.inc(rm, value.Name.Value, now)
+			continue
+		}
+
+		metricName, scale := metricNameFrom(rm.metricNamespace, value.Name.Value, value.Unit, sc.C.MetricNaming.NormalizeUnits)
+		aggregations := rm.aggregations
+		metric, ok := rm.metricOptions[strings.ToLower(value.Name.Value)]
+		if ok {
+			aggregations = metric.Aggregations
+			if metric.Rename != "" {
+				metricName = metric.Rename
+			}
+		}
+
+		data := value.Timeseries[0].Data
+		metricValue := data[len(data)-1]
+		labels := CreateMetricLabels(rm)
+		help := metric.Help
+		if help == "" {
+			help = metricHelp(rm, value.Name.Value, value.Unit)
+		}
+
+		if sampleTime, err := time.Parse(time.RFC3339, metricValue.TimeStamp); err == nil {
+			if len(rm.options.Rollups) == 0 {
+				for _, s := range freshnessSeries(labels, value.Name.Value, sampleTime, now) {
+					w.write(s)
+				}
 			}
+			// A group is as fresh as its stalest resource.
+			for _, r := range rm.options.Rollups {
+				f := freshnessSeries(rollupLabels(rm, r.By), value.Name.Value, sampleTime, now)
+				rollups.add(f[0], "Minimum", nil)
+				rollups.add(f[1], "Maximum", nil)
+			}
+		}
 
-			if hasAggregation(rm.aggregations, "Average") {
-				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(metricName+"_average", metricName+"_average", nil, labels),
-					prometheus.GaugeValue,
-					metricValue.Average,
-				)
+		for _, aggregation := range filterAggregations(nil) {
+			if !hasAggregation(aggregations, aggregation) {
+				continue
 			}
 
-			if hasAggregation(rm.aggregations, "Minimum") {
-				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(metricName+"_min", metricName+"_min", nil, labels),
-					prometheus.GaugeValue,
-					metricValue.Minimum,
-				)
+			var (
+				v         float64
+				timestamp time.Time
+				counter   bool
+			)
+			switch {
+			case aggregation == "Total" && sc.C.TotalCounters.Enabled:
+				total, err := counters.add(counterKey(rm, value.Name.Value), data)
+				if err != nil {
+					log.Printf("Error counting metric %s of resource %s: %v", value.Name.Value, rm.resourceID, err)
+					continue
+				}
+				v, counter = total, true
+			// Rollups aggregate the latest buckets of their resources.
+			case sc.C.LateData.Enabled && len(rm.options.Rollups) == 0:
+				buckets, err := bucketsOf(data, aggregation)
+				if err != nil {
+					log.Printf("Error reading metric %s of resource %s: %v", value.Name.Value, rm.resourceID, err)
+					continue
+				}
+				b, ok := lateBuckets.next(counterKey(rm, value.Name.Value)+"|"+aggregation, buckets, sc.C.LateData.LookbackOrDefault())
+				if !ok {
+					continue
+				}
+				v, timestamp = b.value, b.time
+			default:
+				var ok bool
+				if v, ok = metricValue.value(aggregation); !ok {
+					continue
+				}
 			}
 
-			if hasAggregation(rm.aggregations, "Maximum") {
-				ch <- prometheus.MustNewConstMetric(
-					prometheus.NewDesc(metricName+"_max", metricName+"_max", nil, labels),
-					prometheus.GaugeValue,
-					metricValue.Maximum,
-				)
+			newSeries := func(labels map[string]string) series {
+				if counter {
+					return counterSeries(metricName, help, labels, v*scale)
+				}
+				s := aggregationSeries(metricName, help, labels, aggregation, v*scale)
+				s.timestamp = timestamp
+				return s
+			}
+			if len(rm.options.Rollups) == 0 {
+				s := newSeries(labels)
+				s.selector = rm.selector
+				w.write(s)
+			}
+			// Buckets without samples would add bogus zeros to the rollups, counters keep their value.
+			if !counter && queriesCount(rm) && (metricValue.Count == nil || *metricValue.Count == 0) {
+				continue
+			}
+			for _, r := range rm.options.Rollups {
+				rollups.add(newSeries(rollupLabels(rm, r.By)), aggregation, metricValue.Count)
 			}
 		}
 	}
+}
 
-	if _, ok := publishedResources[rm.resource.ID]; !ok {
-		infoLabels := CreateAllResourceLabelsFrom(rm)
-		ch <- prometheus.MustNewConstMetric(
-			prometheus.NewDesc("azure_resource_info", "Azure information available for resource", nil, infoLabels),
-			prometheus.GaugeValue,
-			1,
-		)
-		publishedResources[rm.resource.ID] = true
+// metricHelp returns the description of a metric from its cached definition, if any.
+func metricHelp(rm resourceMeta, metric string, unit string) string {
+	def, ok := ac.definitions.lookup(GetResourceType(rm.resourceURL), rm.metricNamespace, metric)
+	if ok && def.DisplayDescription != "" {
+		return def.DisplayDescription
+	}
+	if ok && def.Name.LocalizedValue != "" {
+		return fmt.Sprintf("%s in %s", def.Name.LocalizedValue, unit)
 	}
+	return fmt.Sprintf("Azure metric %s in %s", metric, unit)
 }
 
-func (c *Collector) batchCollectMetrics(ch chan<- prometheus.Metric, resources []resourceMeta) {
-	var publishedResources = map[string]bool{}
+// aggregationSeries builds the series of an aggregation of a metric, named according to the metric_naming config.
+func aggregationSeries(metricName string, help string, labels map[string]string, aggregation string, value float64) series {
+	naming := sc.C.MetricNaming
+	if naming.Mode == config.NamingLabel {
+		aggregationLabels := make(map[string]string, len(labels)+1)
+		for k, v := range labels {
+			aggregationLabels[k] = v
+		}
+		aggregationLabels["aggregation"] = strings.ToLower(aggregation)
+		return series{name: metricName, help: help, labels: aggregationLabels, value: value}
+	}
+	return series{
+		name:   metricName + naming.Suffix(aggregation),
+		help:   fmt.Sprintf("%s, %s aggregation", help, strings.ToLower(aggregation)),
+		labels: labels,
+		value:  value,
+	}
+}
 
-	// collect metrics in batches
-	for i := 0; i < len(resources); i += batchSize {
-		j := i + batchSize
+// counterSeries builds the counter of the Total aggregation of a metric. It is named with the Total suffix,
+// and is its own metric in the label naming mode as counters and gauges can't share a metric.
+func counterSeries(metricName string, help string, labels map[string]string, value float64) series {
+	suffix := "_total"
+	if sc.C.MetricNaming.Mode != config.NamingLabel {
+		suffix = sc.C.MetricNaming.Suffix("Total")
+	}
+	return series{
+		name:      metricName + suffix,
+		help:      help + ", total aggregation counter",
+		labels:    labels,
+		value:     value,
+		valueType: prometheus.CounterValue,
+	}
+}
 
-		// don't forget to add remainder resources
-		if j > len(resources) {
-			j = len(resources)
-		}
+func (c *Collector) batchCollectMetrics(ch chan<- prometheus.Metric, w *seriesWriter, resources []resourceMeta) {
+	rollups := newRollupSet()
+
+	var urls []string
+	for _, r := range resources {
+		urls = append(urls, r.resourceURL)
+	}
+	// Metric baselines are queried in the same batches, after the metrics.
+	baselines := baselineQueries(resources)
+	for _, b := range baselines {
+		urls = append(urls, b.url)
+	}
+
+	responses, err := ac.getBatchResponses(urls)
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+		return
+	}
 
-		var urls []string
-		for _, r := range resources[i:j] {
-			urls = append(urls, r.resourceURL)
+	for i, r := range resources {
+		resp, ok := responses[i]
+		if !ok {
+			log.Printf("No batch response received for resource %s", r.resourceURL)
+			continue
 		}
 
-		batchBody, err := ac.getBatchResponseBody(urls)
+		var metricValueData AzureMetricValueResponse
+		err := json.Unmarshal(resp.Content, &metricValueData)
 		if err != nil {
-			ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
-			return
+			log.Printf("Error unmarshalling metric response for resource %s: %v", r.resourceURL, err)
+			continue
 		}
+		c.extractMetrics(w, rollups, r, resp.HttpStatusCode, metricValueData)
+	}
 
-		var batchData AzureBatchMetricResponse
-		err = json.Unmarshal(batchBody, &batchData)
-		if err != nil {
-			ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
-			return
+	for i, b := range baselines {
+		resp, ok := responses[len(resources)+i]
+		if !ok {
+			log.Printf("No batch response received for metric baselines %s", b.url)
+			continue
 		}
 
-		for k, resp := range batchData.Responses {
-			c.extractMetrics(ch, resources[i+k], resp.HttpStatusCode, resp.Content, publishedResources)
+		var baselineData AzureMetricBaselineResponse
+		if err := json.Unmarshal(resp.Content, &baselineData); err != nil {
+			log.Printf("Error unmarshalling metric baselines response %s: %v", b.url, err)
+			continue
 		}
+		c.extractBaselines(w, b, resp.HttpStatusCode, baselineData)
+	}
+
+	for _, s := range rollups.series() {
+		w.write(s)
+	}
+
+	for _, s := range emptyResponses.series(time.Now()) {
+		w.write(s)
 	}
 }
 
 func (c *Collector) batchLookupResources(resources []resourceMeta) ([]resourceMeta, error) {
-	var updatedResources = resources
+	var urls []string
+	for _, r := range resources {
+		resourceType := GetResourceType(r.resourceURL)
+		if resourceType == "" {
+			return nil, fmt.Errorf("No type found for resource: %s", r.resourceID)
+		}
+
+		apiVersion := ac.APIVersions.findBy(resourceType)
+		if apiVersion == "" {
+			return nil, fmt.Errorf("No api version found for type: %s", resourceType)
+		}
+
+		resourcesEndpoint := fmt.Sprintf("%s?api-version=%s", fullResourceID(r.resourceID), apiVersion)
+
+		urls = append(urls, resourcesEndpoint)
+	}
+
 	// collect resource info in batches
-	for i := 0; i < len(resources); i += batchSize {
-		j := i + batchSize
+	responses, err := ac.getBatchResponses(urls)
+	if err != nil {
+		return nil, err
+	}
+
+	var updatedResources []resourceMeta
+	for i, r := range resources {
+		resp, ok := responses[i]
+		if !ok {
+			log.Printf("No batch response received for resource %s", r.resourceID)
+			continue
+		}
+		if resp.HttpStatusCode != 200 {
+			log.Printf("Received %d status looking up resource %s", resp.HttpStatusCode, r.resourceID)
+			continue
+		}
+
+		err := json.Unmarshal(resp.Content, &r.resource)
+		if err != nil {
+			log.Printf("Error unmarshalling resource %s: %v", r.resourceID, err)
+			continue
+		}
+		r.resource.Subscription = subscriptionFrom(r.resourceID)
+		updatedResources = append(updatedResources, r)
+	}
+	return updatedResources, nil
+}
+
+// filterProvisioningStates drops the resources whose provisioning state is not one of the
+// provisioning_states of their selector. Resources with an unknown provisioning state are kept.
+func filterProvisioningStates(resources []resourceMeta) []resourceMeta {
+	var filtered []resourceMeta
+	for _, r := range resources {
+		state := r.resource.GetProvisioningState()
+		if len(r.options.ProvisioningStates) > 0 && state != "" && !hasState(r.options.ProvisioningStates, state) {
+			log.Printf("Skipping resource %s in provisioning state %s", r.resourceID, state)
+			continue
+		}
+		filtered = append(filtered, r)
+	}
+	return filtered
+}
+
+// batchFilterPowerStates looks up the power state of the virtual machines whose selector sets power_states
+// or export_power_state. It exports it as azure_vm_power_state with export_power_state, and drops the machines
+// that are not in one of the power_states. Machines whose power state is unknown are kept.
+func (c *Collector) batchFilterPowerStates(w *seriesWriter, resources []resourceMeta) ([]resourceMeta, error) {
+	var vms []int
+	var urls []string
+	for i, r := range resources {
+		resourceType := GetResourceType(r.resourceURL)
+		if (len(r.options.PowerStates) == 0 && !r.options.ExportPowerState) || !strings.EqualFold(resourceType, "Microsoft.Compute/virtualMachines") {
+			continue
+		}
+
+		apiVersion := ac.APIVersions.findBy(resourceType)
+		if apiVersion == "" {
+			return nil, fmt.Errorf("No api version found for type: %s", resourceType)
+		}
+		urls = append(urls, fmt.Sprintf("%s/instanceView?api-version=%s", fullResourceID(r.resourceID), apiVersion))
+		vms = append(vms, i)
+	}
+	if len(urls) == 0 {
+		return resources, nil
+	}
+
+	// look up instance views in batches
+	responses, err := ac.getBatchResponses(urls)
+	if err != nil {
+		return nil, err
+	}
+
+	skipped := make(map[int]bool)
+	for k, i := range vms {
+		r := resources[i]
+		resp, ok := responses[k]
+		if !ok {
+			log.Printf("No batch response received for instance view of resource %s", r.resourceID)
+			continue
+		}
+		if resp.HttpStatusCode != 200 {
+			log.Printf("Received %d status looking up instance view of resource %s", resp.HttpStatusCode, r.resourceID)
+			continue
+		}
+
+		var instanceView AzureVMInstanceView
+		err := json.Unmarshal(resp.Content, &instanceView)
+		if err != nil {
+			log.Printf("Error unmarshalling instance view of resource %s: %v", r.resourceID, err)
+			continue
+		}
+
+		state := instanceView.GetPowerState()
+		if state == "" {
+			state = "unknown"
+		}
+		if r.options.ExportPowerState {
+			for _, s := range powerStates {
+				value := 0.0
+				if s == state {
+					value = 1
+				}
+				labels := CreateMetricLabels(r)
+				labels["state"] = s
+				w.write(series{
+					name:   "azure_vm_power_state",
+					help:   "Power state of the virtual machine",
+					labels: labels,
+					value:  value,
+				})
+			}
+		}
+
+		if len(r.options.PowerStates) > 0 && state != "unknown" && !hasState(r.options.PowerStates, state) {
+			log.Printf("Skipping virtual machine %s in power state %s", r.resourceID, state)
+			skipped[i] = true
+		}
+	}
+
+	var filtered []resourceMeta
+	for i, r := range resources {
+		if !skipped[i] {
+			filtered = append(filtered, r)
+		}
+	}
+	return filtered, nil
+}
+
+// inheritResourceGroupTags adds the tags of their resource group to the inherited tags of the
+// resources that inherit them, either globally or through their selector.
+func (c *Collector) inheritResourceGroupTags(resources []resourceMeta) error {
+	// tags of each resource group, by subscription and resource group name
+	groupTags := make(map[string]map[string]map[string]string)
+	for i, r := range resources {
+		if !sc.C.InheritResourceGroupTags && !r.options.InheritResourceGroupTags {
+			continue
+		}
+
+		id, err := ParseResourceID(fullResourceID(r.resourceID))
+		if err != nil || id.ResourceGroup == "" {
+			continue
+		}
+
+		subscription := strings.ToLower(id.SubscriptionID)
+		if _, ok := groupTags[subscription]; !ok {
+			groups, err := ac.listResourceGroupResources(id.SubscriptionID)
+			if err != nil {
+				return err
+			}
+			groupTags[subscription] = make(map[string]map[string]string)
+			for _, group := range groups {
+				groupTags[subscription][strings.ToLower(group.Name)] = group.Tags
+			}
+		}
+		resources[i].inheritedTags = mergeTags(groupTags[subscription][strings.ToLower(id.ResourceGroup)], r.inheritedTags)
+	}
+	return nil
+}
 
-		// don't forget to add remainder resources
-		if j > len(resources) {
-			j = len(resources)
+// mergeTags returns the tags of base overridden by the tags of overrides.
+func mergeTags(base map[string]string, overrides map[string]string) map[string]string {
+	merged := make(map[string]string)
+	for k, v := range base {
+		merged[k] = v
+	}
+	for k, v := range overrides {
+		merged[k] = v
+	}
+	return merged
+}
+
+// hasState reports whether state is one of states, compared case-insensitively.
+func hasState(states []string, state string) bool {
+	for _, s := range states {
+		if strings.EqualFold(s, state) {
+			return true
 		}
+	}
+	return false
+}
 
-		var urls []string
-		for _, r := range resources[i:j] {
+// batchListSubResources lists the child resources configured in sub_resources for each of the given resources.
+// The children are returned ready to be queried with the metrics of their sub_resources entry.
+func (c *Collector) batchListSubResources(resources []resourceMeta) ([]resourceMeta, error) {
+	type parentSubResource struct {
+		parent      resourceMeta
+		subResource config.SubResource
+	}
+
+	var parents []parentSubResource
+	var urls []string
+	for _, r := range resources {
+		for _, subResource := range r.options.SubResources {
 			resourceType := GetResourceType(r.resourceURL)
 			if resourceType == "" {
 				return nil, fmt.Errorf("No type found for resource: %s", r.resourceID)
 			}
-
+			resourceType += "/" + subResource.ResourceType
 			apiVersion := ac.APIVersions.findBy(resourceType)
 			if apiVersion == "" {
 				return nil, fmt.Errorf("No api version found for type: %s", resourceType)
 			}
 
-			subscription := fmt.Sprintf("subscriptions/%s", sc.C.Credentials.SubscriptionID)
-			resourcesEndpoint := fmt.Sprintf("/%s/%s?api-version=%s", subscription, r.resourceID, apiVersion)
+			urls = append(urls, fmt.Sprintf("%s/%s?api-version=%s", fullResourceID(r.resourceID), subResource.ResourceType, apiVersion))
+			parents = append(parents, parentSubResource{r, subResource})
+		}
+	}
+
+	// list sub resources in batches
+	responses, err := ac.getBatchResponses(urls)
+	if err != nil {
+		return nil, err
+	}
 
-			urls = append(urls, resourcesEndpoint)
+	var subResources []resourceMeta
+	for i, p := range parents {
+		resp, ok := responses[i]
+		if !ok {
+			log.Printf("No batch response received listing %s of resource %s", p.subResource.ResourceType, p.parent.resourceID)
+			continue
+		}
+		if resp.HttpStatusCode != 200 {
+			log.Printf("Received %d status listing %s of resource %s", resp.HttpStatusCode, p.subResource.ResourceType, p.parent.resourceID)
+			continue
 		}
 
-		batchBody, err := ac.getBatchResponseBody(urls)
+		body, err := followNextLinks(resp.Content)
 		if err != nil {
-			return nil, err
+			log.Printf("Error listing %s of resource %s: %v", p.subResource.ResourceType, p.parent.resourceID, err)
+			continue
 		}
-
-		var batchData AzureBatchLookupResponse
-		err = json.Unmarshal(batchBody, &batchData)
+		var data AzureResourceListResponse
+		err = json.Unmarshal(body, &data)
 		if err != nil {
-			return nil, fmt.Errorf("Error unmarshalling response body: %v", err)
+			log.Printf("Error unmarshalling %s of resource %s: %v", p.subResource.ResourceType, p.parent.resourceID, err)
+			continue
+		}
+
+		q := newMetricQuery(p.subResource.Metrics, p.subResource.Aggregations, p.subResource.MetricNameIncludeRe, p.subResource.MetricNameExcludeRe)
+
+		parentName := p.parent.resource.Name
+		if parentName == "" {
+			if id, err := ParseResourceID(p.parent.resourceID); err == nil {
+				parentName = id.Name()
+			}
 		}
 
-		for k, resp := range batchData.Responses {
-			updatedResources[i+k].resource = resp.Content
-			updatedResources[i+k].resource.Subscription = sc.C.Credentials.SubscriptionID
+		children := ac.filterResources(data.extendResources(), p.subResource.ResourceNameIncludeRe, p.subResource.ResourceNameExcludeRe)
+		for _, f := range children {
+			var rm resourceMeta
+			rm.resourceID = f.ID
+			rm.metricNamespace = p.subResource.MetricNamespace
+			rm.metrics = q.metrics
+			rm.aggregations = q.aggregations
+			rm.metricOptions = q.options
+			rm.metricFilters = q.filters
+			rm.resourceURL = resourceURLFrom(f.ID, rm.metricNamespace, rm.metrics, rm.aggregations)
+			rm.resource = f
+			rm.parentResourceName = parentName
+			rm.options.Labels = p.parent.options.Labels
+			rm.options.TagLabels = p.parent.options.TagLabels
+			rm.options.InheritResourceGroupTags = p.parent.options.InheritResourceGroupTags
+			rm.options.Rollups = p.parent.options.Rollups
+			rm.options.MaxSeries = p.parent.options.MaxSeries
+			rm.selector = p.parent.selector
+			rm.inheritedTags = mergeTags(p.parent.inheritedTags, p.parent.resource.Tags)
+			subResources = append(subResources, rm)
 		}
 	}
-	return updatedResources, nil
+	return subResources, nil
 }
 
-// Collect - collect results from Azure Montior API and create Prometheus metrics.
-func (c *Collector) Collect(ch chan<- prometheus.Metric) {
-	if err := ac.refreshAccessToken(); err != nil {
-		log.Println(err)
-		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
-		return
-	}
-
+// listSelectedResources lists the resources of all targets and selectors. Resources of targets and
+// tag selectors are returned as incomplete, to be looked up before they are queried.
+func (c *Collector) listSelectedResources() ([]resourceMeta, []resourceMeta, error) {
 	var resources []resourceMeta
 	var incompleteResources []resourceMeta
 
-	for _, target := range sc.C.Targets {
+	for i, target := range sc.C.Targets {
 		var rm resourceMeta
+		rm.selector = selectorName("targets", i)
 
-		metrics := []string{}
-		for _, metric := range target.Metrics {
-			metrics = append(metrics, metric.Name)
-		}
+		q := newMetricQuery(target.Metrics, target.Aggregations, target.MetricNameIncludeRe, target.MetricNameExcludeRe)
 
 		rm.resourceID = target.Resource
 		rm.metricNamespace = target.MetricNamespace
-		rm.metrics = strings.Join(metrics, ",")
-		rm.aggregations = filterAggregations(target.Aggregations)
+		rm.metrics = q.metrics
+		rm.aggregations = q.aggregations
+		rm.metricOptions = q.options
+		rm.metricFilters = q.filters
+		rm.options = target.SelectorOptions
 		rm.resourceURL = resourceURLFrom(target.Resource, rm.metricNamespace, rm.metrics, rm.aggregations)
 		incompleteResources = append(incompleteResources, rm)
 	}
 
-	for _, resourceGroup := range sc.C.ResourceGroups {
-		metrics := []string{}
-		for _, metric := range resourceGroup.Metrics {
-			metrics = append(metrics, metric.Name)
-		}
-		metricsStr := strings.Join(metrics, ",")
+	for i, resourceGroup := range sc.C.ResourceGroups {
+		selector := selectorName("resource_groups", i)
+		q := newMetricQuery(resourceGroup.Metrics, resourceGroup.Aggregations, resourceGroup.MetricNameIncludeRe, resourceGroup.MetricNameExcludeRe)
 
 		filteredResources, err := ac.filteredListFromResourceGroup(resourceGroup)
 		if err != nil {
 			log.Printf("Failed to get resources for resource group %s and resource types %s: %v",
 				resourceGroup.ResourceGroup, resourceGroup.ResourceTypes, err)
-			ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
-			return
+			return nil, nil, err
 		}
 
+		var selected []resourceMeta
 		for _, f := range filteredResources {
 			var rm resourceMeta
+			rm.selector = selector
 			rm.resourceID = f.ID
 			rm.metricNamespace = resourceGroup.MetricNamespace
-			rm.metrics = metricsStr
-			rm.aggregations = filterAggregations(resourceGroup.Aggregations)
+			rm.metrics = q.metrics
+			rm.aggregations = q.aggregations
+			rm.metricOptions = q.options
+			rm.metricFilters = q.filters
+			rm.options = resourceGroup.SelectorOptions
 			rm.resourceURL = resourceURLFrom(f.ID, rm.metricNamespace, rm.metrics, rm.aggregations)
 			rm.resource = f
-			resources = append(resources, rm)
+			selected = append(selected, rm)
 		}
+		resources = append(resources, selected...)
 	}
 
-	resourcesCache := make(map[string][]byte)
-	for _, resourceTag := range sc.C.ResourceTags {
-		metrics := []string{}
-		for _, metric := range resourceTag.Metrics {
-			metrics = append(metrics, metric.Name)
+	for i, resourceGraph := range sc.C.ResourceGraphs {
+		selector := selectorName("resource_graph", i)
+		q := newMetricQuery(resourceGraph.Metrics, resourceGraph.Aggregations, resourceGraph.MetricNameIncludeRe, resourceGraph.MetricNameExcludeRe)
+
+		graphResources, err := ac.listFromResourceGraph(resourceGraph)
+		if err != nil {
+			log.Printf("Failed to get resources for resource graph query %s: %v", resourceGraph.Query, err)
+			return nil, nil, err
 		}
-		metricsStr := strings.Join(metrics, ",")
+
+		var selected []resourceMeta
+		for _, f := range graphResources {
+			var rm resourceMeta
+			rm.selector = selector
+			rm.resourceID = f.ID
+			rm.metricNamespace = resourceGraph.MetricNamespace
+			rm.metrics = q.metrics
+			rm.aggregations = q.aggregations
+			rm.metricOptions = q.options
+			rm.metricFilters = q.filters
+			rm.options = resourceGraph.SelectorOptions
+			rm.resourceURL = resourceURLFrom(f.ID, rm.metricNamespace, rm.metrics, rm.aggregations)
+			rm.resource = f
+			selected = append(selected, rm)
+		}
+		resources = append(resources, selected...)
+	}
+
+	resourcesCache := make(map[string][]byte)
+	for i, resourceTag := range sc.C.ResourceTags {
+		selector := selectorName("resource_tags", i)
+		q := newMetricQuery(resourceTag.Metrics, resourceTag.Aggregations, resourceTag.MetricNameIncludeRe, resourceTag.MetricNameExcludeRe)
 
 		filteredResources, err := ac.filteredListByTag(resourceTag, resourcesCache)
 		if err != nil {
-			log.Printf("Failed to get resources for tag name %s, tag value %s: %v",
-				resourceTag.ResourceTagName, resourceTag.ResourceTagValue, err)
-			ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
-			return
+			log.Printf("Failed to get resources for tag name %s, tag value %s, tag selector %s: %v",
+				resourceTag.ResourceTagName, resourceTag.ResourceTagValue, resourceTag.ResourceTagSelector, err)
+			return nil, nil, err
 		}
 
+		var selected []resourceMeta
 		for _, f := range filteredResources {
 			var rm resourceMeta
+			rm.selector = selector
 			rm.resourceID = f.ID
 			rm.metricNamespace = resourceTag.MetricNamespace
-			rm.metrics = metricsStr
-			rm.aggregations = filterAggregations(resourceTag.Aggregations)
+			rm.metrics = q.metrics
+			rm.aggregations = q.aggregations
+			rm.metricOptions = q.options
+			rm.metricFilters = q.filters
+			rm.options = resourceTag.SelectorOptions
 			rm.resourceURL = resourceURLFrom(f.ID, rm.metricNamespace, rm.metrics, rm.aggregations)
+			selected = append(selected, rm)
+		}
+		incompleteResources = append(incompleteResources, selected...)
+	}
+
+	for i, resourceType := range sc.C.ResourceTypes {
+		selector := selectorName("resource_types", i)
+		q := newMetricQuery(resourceType.Metrics, resourceType.Aggregations, resourceType.MetricNameIncludeRe, resourceType.MetricNameExcludeRe)
+
+		filteredResources, err := ac.filteredListByType(resourceType, resourcesCache)
+		if err != nil {
+			log.Printf("Failed to get resources for resource types %s: %v", resourceType.ResourceTypes, err)
+			return nil, nil, err
+		}
+
+		var selected []resourceMeta
+		for _, f := range filteredResources {
+			var rm resourceMeta
+			rm.selector = selector
+			rm.resourceID = f.ID
+			rm.metricNamespace = resourceType.MetricNamespace
+			rm.metrics = q.metrics
+			rm.aggregations = q.aggregations
+			rm.metricOptions = q.options
+			rm.metricFilters = q.filters
+			rm.options = resourceType.SelectorOptions
+			rm.resourceURL = resourceURLFrom(f.ID, rm.metricNamespace, rm.metrics, rm.aggregations)
+			rm.resource = f
+			selected = append(selected, rm)
+		}
+		resources = append(resources, selected...)
+	}
+
+	return resources, incompleteResources, nil
+}
+
+// Collect - collect results from Azure Montior API and create Prometheus metrics.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	if err := ac.refreshAccessToken(); err != nil {
+		log.Println(err)
+		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+		return
+	}
+
+	w := newSeriesWriter(ch, sc.C.MetricRelabelConfigs)
+	w.maxSeries = sc.C.MaxSeries
+
+	resources, incompleteResources, err := c.listSelectedResources()
+	if err != nil {
+		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+		return
+	}
+
+	// max_resources only limits the resources queried, the inventory holds every resource discovered.
+	limited := make(map[string]bool)
+	for _, rm := range c.limits.limitSelectors(append(resources, incompleteResources...)) {
+		limited[resourceKey(rm)] = true
+	}
+
+	merged, overlapping := mergeResources(append(resources, incompleteResources...))
+
+	resources, incompleteResources = nil, nil
+	for _, rm := range merged {
+		if rm.resource.ID == "" {
 			incompleteResources = append(incompleteResources, rm)
+		} else {
+			resources = append(resources, rm)
 		}
 	}
 
@@ -299,8 +1086,74 @@ func (c *Collector) Collect(ch chan<- prometheus.Metric) {
 		return
 	}
 
-	resources = append(resources, completeResources...)
-	c.batchCollectMetrics(ch, resources)
+	discovered := append(resources, completeResources...)
+	resources = nil
+	for _, rm := range discovered {
+		if limited[resourceKey(rm)] {
+			resources = append(resources, rm)
+		}
+	}
+	// The global max_resources counts the selected resources only, their sub resources are not listed yet.
+	resources = c.limits.limitResources(resources, globalSelector, sc.C.MaxResources)
+	resources = filterProvisioningStates(resources)
+
+	resources, err = c.batchFilterPowerStates(w, resources)
+	if err != nil {
+		log.Printf("Failed to get power states: %s", err)
+		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+		return
+	}
+
+	subResources, err := c.batchListSubResources(resources)
+	if err != nil {
+		log.Printf("Failed to get sub resources: %s", err)
+		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+		return
+	}
+	writeInventory(w, append(discovered, subResources...))
+
+	// Sub resources also matched by a selector, or listed under several parents, are queried once.
+	resources, subOverlapping := mergeResources(append(resources, subResources...))
+	ch <- prometheus.MustNewConstMetric(overlappingDesc, prometheus.GaugeValue, float64(overlapping+subOverlapping))
+
+	err = c.inheritResourceGroupTags(resources)
+	if err != nil {
+		log.Printf("Failed to get resource group tags: %s", err)
+		ch <- prometheus.NewInvalidMetric(azureErrorDesc, err)
+		return
+	}
+	if err := ac.batchLookupMetricDefinitions(resources); err != nil {
+		log.Printf("Failed to get metric definitions: %s", err)
+	}
+	resources = planQueries(c.limits.limitSeries(resolveMetrics(resources)))
+	if err := ac.batchLookupMetricDefinitions(resources); err != nil {
+		log.Printf("Failed to get metric definitions: %s", err)
+	}
+	for _, rm := range resources {
+		if rm.options.MaxSeries > 0 {
+			w.selectorMaxSeries[rm.selector] = rm.options.MaxSeries
+		}
+	}
+	c.batchCollectMetrics(ch, w, resources)
+	if w.maxSeries > 0 {
+		c.limits.report(globalSelector, "max_series", w.exceeded[globalSelector])
+	}
+	for selector := range w.selectorMaxSeries {
+		c.limits.report(selector, "max_series", w.exceeded[selector])
+	}
+	c.limits.collect(ch)
+
+	if sc.C.LateData.Enabled {
+		lateBuckets.forget(time.Now().Add(-time.Hour))
+	}
+	if sc.C.TotalCounters.Enabled {
+		counters.prune(time.Now())
+	}
+	if sc.C.TotalCounters.Enabled && sc.C.TotalCounters.StateFile != "" {
+		if err := counters.save(sc.C.TotalCounters.StateFile); err != nil {
+			log.Printf("Failed to save counters: %v", err)
+		}
+	}
 }
 
 func handler(w http.ResponseWriter, r *http.Request) {
@@ -311,6 +1164,45 @@ func handler(w http.ResponseWriter, r *http.Request) {
 	h.ServeHTTP(w, r)
 }
 
+// checkConfiguredMetrics checks the configured metrics when --config.check-metrics or --config.strict is set,
+// logging the problems found. It returns an error if problems were found in strict mode.
+func checkConfiguredMetrics() error {
+	if !*checkMetrics && !*strictConfig {
+		return nil
+	}
+	problems, err := (&Collector{}).checkMetrics()
+	if err != nil {
+		problems = append(problems, fmt.Sprintf("Failed to check metrics: %v", err))
+	}
+	for _, p := range problems {
+		log.Printf("Warning: %s", p)
+	}
+	if *strictConfig && len(problems) > 0 {
+		return fmt.Errorf("Found %d problems checking the configured metrics", len(problems))
+	}
+	return nil
+}
+
+// reloadConfig reads the config file again and checks its metrics. In strict mode, the previous
+// config is kept if the check finds a problem.
+func reloadConfig() error {
+	sc.RLock()
+	previous := sc.C
+	sc.RUnlock()
+
+	if err := sc.ReloadConfig(*configFile); err != nil {
+		return err
+	}
+	if err := checkConfiguredMetrics(); err != nil {
+		sc.Lock()
+		sc.C = previous
+		sc.Unlock()
+		return fmt.Errorf("%v, keeping the previous config", err)
+	}
+	log.Printf("Reloaded config file %s", *configFile)
+	return nil
+}
+
 func main() {
 	kingpin.HelpFlag.Short('h')
 	kingpin.Parse()
@@ -318,6 +1210,12 @@ func main() {
 		log.Fatalf("Error loading config: %v", err)
 	}
 
+	if sc.C.TotalCounters.Enabled && sc.C.TotalCounters.StateFile != "" {
+		if err := counters.load(sc.C.TotalCounters.StateFile); err != nil {
+			log.Fatalf("Error loading counters: %v", err)
+		}
+	}
+
 	err := ac.getAccessToken()
 	if err != nil {
 		log.Fatalf("Failed to get token: %v", err)
@@ -360,6 +1258,20 @@ func main() {
 		log.Fatal(err)
 	}
 
+	if err := checkConfiguredMetrics(); err != nil {
+		log.Fatal(err)
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if err := reloadConfig(); err != nil {
+				log.Printf("Error reloading config: %v", err)
+			}
+		}
+	}()
+
 	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
 		w.Write([]byte(`<html>
             <head>
@@ -372,6 +1284,16 @@ func main() {
             </html>`))
 	})
 
+	http.HandleFunc("/-/reload", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "POST" {
+			http.Error(w, "This endpoint requires a POST request.", http.StatusMethodNotAllowed)
+			return
+		}
+		if err := reloadConfig(); err != nil {
+			http.Error(w, fmt.Sprintf("Error reloading config: %v", err), http.StatusInternalServerError)
+		}
+	})
+
 	http.HandleFunc("/metrics", handler)
 	log.Printf("azure_metrics_exporter listening on port %v", *listenAddress)
 	if err := http.ListenAndServe(*listenAddress, nil); err != nil {
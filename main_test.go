@@ -0,0 +1,542 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestMergeResources(t *testing.T) {
+	sc.C = &config.Config{
+		Credentials: config.Credentials{SubscriptionID: "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6"},
+	}
+
+	vm := "/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01"
+	resources := []resourceMeta{
+		{resourceID: vm, metrics: "Percentage CPU", aggregations: []string{"Average"}},
+		{resourceID: "/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-02", metrics: "Percentage CPU"},
+		{
+			resourceID:   "/subscriptions/ABC123D4-E5F6-G7H8-I9J10-A1B2C3D4E5F6/resourcegroups/PROD-RG-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+			metrics:      "percentage cpu,Network In Total",
+			aggregations: []string{"Average", "Total"},
+			resource:     AzureResource{ID: vm},
+		},
+		{resourceID: vm, metricNamespace: "Azure.VM.Windows.GuestMetrics", metrics: `Process\Thread Count`},
+	}
+
+	merged, overlapping := mergeResources(resources)
+
+	if overlapping != 1 {
+		t.Errorf("doesn't count overlapping resources\ngot: %d\nwant: 1", overlapping)
+	}
+	if len(merged) != 3 {
+		t.Fatalf("doesn't merge overlapping resources\ngot: %d resources\nwant: 3", len(merged))
+	}
+
+	got := merged[0]
+	if got.resourceID != vm || got.metrics != "Percentage CPU,Network In Total" {
+		t.Errorf("doesn't merge metrics\ngot: %s %s", got.resourceID, got.metrics)
+	}
+	if !reflect.DeepEqual(got.aggregations, []string{"Average", "Total"}) {
+		t.Errorf("doesn't merge aggregations\ngot: %v", got.aggregations)
+	}
+	if got.resource.ID != vm {
+		t.Errorf("doesn't keep resource information\ngot: %v", got.resource)
+	}
+	if !strings.Contains(got.resourceURL, "metricnames=Percentage+CPU%2CNetwork+In+Total") {
+		t.Errorf("doesn't rebuild resource URL\ngot: %s", got.resourceURL)
+	}
+}
+
+func TestMergeSelectorOptions(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	sc.C.TagLabels = []string{"team"}
+	label := func(text string) config.Template {
+		return config.Template{Template: template.Must(template.New("label").Parse(text))}
+	}
+
+	a := config.SelectorOptions{
+		PowerStates: []string{"running"},
+		Labels:      map[string]config.Template{"env": label("prod")},
+		Rollups:     []config.Rollup{{By: []string{"resource_group"}}},
+	}
+	b := config.SelectorOptions{
+		ProvisioningStates: []string{"Succeeded"},
+		TagLabels:          []string{"env"},
+		Labels:             map[string]config.Template{"env": label("dev"), "owner": label("{{ .Name }}")},
+		Rollups:            []config.Rollup{{By: []string{"resource_group"}}, {By: []string{"location"}}},
+	}
+
+	got := mergeSelectorOptions(a, b, "vm")
+	if got.PowerStates != nil || got.ProvisioningStates != nil {
+		t.Errorf("doesn't keep every state when a selector has no filter\ngot: %v %v", got.PowerStates, got.ProvisioningStates)
+	}
+	if want := []string{"team", "env"}; !reflect.DeepEqual(got.TagLabels, want) {
+		t.Errorf("doesn't merge tag labels\ngot: %v\nwant: %v", got.TagLabels, want)
+	}
+	if len(got.Labels) != 2 || got.Labels["env"].Tree.Root.String() != "prod" {
+		t.Errorf("doesn't merge labels\ngot: %v", got.Labels)
+	}
+	if want := []config.Rollup{{By: []string{"resource_group"}}, {By: []string{"location"}}}; !reflect.DeepEqual(got.Rollups, want) {
+		t.Errorf("doesn't merge rollups\ngot: %v\nwant: %v", got.Rollups, want)
+	}
+
+	b.PowerStates = []string{"stopped"}
+	if got := mergeSelectorOptions(a, b, "vm"); !reflect.DeepEqual(got.PowerStates, []string{"running", "stopped"}) {
+		t.Errorf("doesn't merge state filters\ngot: %v", got.PowerStates)
+	}
+}
+
+func TestBatchListSubResources(t *testing.T) {
+	queues := "/subscriptions/" + testSubscriptionID + "/resourceGroups/rg/providers/Microsoft.ServiceBus/namespaces/bus/queues"
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The second page of the queues, linked from the batch response.
+		if r.Method == "GET" {
+			json.NewEncoder(w).Encode(map[string]interface{}{"value": []map[string]string{{"id": queues + "/payments", "name": "payments"}}})
+			return
+		}
+
+		var batch batchBody
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+
+		var responses []map[string]interface{}
+		for _, req := range batch.Requests {
+			u, _ := url.Parse(req.RelativeURL)
+			var value []map[string]string
+			switch u.Path {
+			case queues:
+				for _, name := range []string{"orders", "orders-test"} {
+					value = append(value, map[string]string{"id": u.Path + "/" + name, "name": name})
+				}
+			default:
+				t.Errorf("unexpected request for %s", u.Path)
+			}
+			if u.Query().Get("api-version") != "2017-04-01" {
+				t.Errorf("unexpected api version for %s", req.RelativeURL)
+			}
+			responses = append(responses, map[string]interface{}{
+				"name":           req.Name,
+				"httpStatusCode": 200,
+				"content":        map[string]interface{}{"value": value, "nextLink": srv.URL + queues + "?page=1"},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+	ac.APIVersions = APIVersionMap{"Microsoft.ServiceBus/namespaces/queues": "2017-04-01"}
+
+	var subResource config.SubResource
+	err := yaml.Unmarshal([]byte(`
+resource_type: queues
+resource_name_exclude_re: [".*-test"]
+aggregations: ["Total"]
+metrics:
+  - name: "ActiveMessages"
+`), &subResource)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	bus := "/resourceGroups/rg/providers/Microsoft.ServiceBus/namespaces/bus"
+	parents := []resourceMeta{{
+		resourceID:  bus,
+		resourceURL: resourceURLFrom(bus, "", "IncomingMessages", nil),
+		resource:    AzureResource{ID: bus, Name: "bus"},
+		options:     config.SelectorOptions{SubResources: []config.SubResource{subResource}},
+	}}
+
+	children, err := (&Collector{}).batchListSubResources(parents)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	var got []string
+	for _, c := range children {
+		got = append(got, c.parentResourceName+" "+c.resourceID+" "+c.metrics)
+	}
+	want := []string{
+		"bus " + bus + "/queues/orders ActiveMessages",
+		"bus " + bus + "/queues/payments ActiveMessages",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't list sub resources\ngot: %v\nwant: %v", got, want)
+	}
+	if !reflect.DeepEqual(children[0].aggregations, []string{"Total"}) {
+		t.Errorf("doesn't use the aggregations of the sub resource\ngot: %v", children[0].aggregations)
+	}
+}
+
+func TestFilterProvisioningStates(t *testing.T) {
+	options := config.SelectorOptions{ProvisioningStates: []string{"Succeeded"}}
+	resources := []resourceMeta{
+		{resourceID: "succeeded", options: options, resource: AzureResource{Properties: map[string]interface{}{"provisioningState": "Succeeded"}}},
+		{resourceID: "failed", options: options, resource: AzureResource{Properties: map[string]interface{}{"provisioningState": "Failed"}}},
+		{resourceID: "expanded", options: options, resource: AzureResource{ProvisioningState: "succeeded"}},
+		{resourceID: "unknown", options: options},
+		{resourceID: "unfiltered", resource: AzureResource{ProvisioningState: "Failed"}},
+	}
+
+	var got []string
+	for _, r := range filterProvisioningStates(resources) {
+		got = append(got, r.resourceID)
+	}
+	want := []string{"succeeded", "expanded", "unknown", "unfiltered"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't filter provisioning states\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestBatchFilterPowerStates(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var batch batchBody
+		if err := json.NewDecoder(r.Body).Decode(&batch); err != nil {
+			t.Errorf("unexpected error: %v", err)
+			return
+		}
+
+		var responses []map[string]interface{}
+		for _, req := range batch.Requests {
+			statuses := []map[string]string{{"code": "ProvisioningState/succeeded"}}
+			switch {
+			case strings.Contains(req.RelativeURL, "stopped"):
+				statuses = append(statuses, map[string]string{"code": "PowerState/deallocated"})
+			case !strings.Contains(req.RelativeURL, "unknown"):
+				statuses = append(statuses, map[string]string{"code": "PowerState/running"})
+			}
+			responses = append(responses, map[string]interface{}{
+				"name":           req.Name,
+				"httpStatusCode": 200,
+				"content":        map[string]interface{}{"statuses": statuses},
+			})
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"responses": responses})
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+	ac.APIVersions = APIVersionMap{"Microsoft.Compute/virtualMachines": "2021-03-01"}
+
+	filter := config.SelectorOptions{PowerStates: []string{"running"}, ExportPowerState: true}
+	var resources []resourceMeta
+	for _, r := range []struct {
+		name    string
+		options config.SelectorOptions
+	}{
+		{"virtualMachines/running-vm", filter},
+		{"virtualMachines/stopped-vm", filter},
+		{"virtualMachines/unknown-vm", filter},
+		{"virtualMachines/stopped-exported-vm", config.SelectorOptions{ExportPowerState: true}},
+		{"virtualMachines/filtered-vm", config.SelectorOptions{PowerStates: []string{"running"}}},
+		{"virtualMachines/unfiltered-vm", config.SelectorOptions{}},
+	} {
+		id := "/resourceGroups/rg/providers/Microsoft.Compute/" + r.name
+		resources = append(resources, resourceMeta{
+			resourceID:  id,
+			resourceURL: resourceURLFrom(id, "", "CPU", nil),
+			options:     r.options,
+		})
+	}
+	app := "/resourceGroups/rg/providers/Microsoft.Web/sites/app"
+	resources = append(resources, resourceMeta{resourceID: app, resourceURL: resourceURLFrom(app, "", "CPU", nil), options: filter})
+
+	ch := make(chan prometheus.Metric, 100)
+	filtered, err := (&Collector{}).batchFilterPowerStates(newSeriesWriter(ch, nil), resources)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	close(ch)
+
+	var got []string
+	for _, r := range filtered {
+		got = append(got, r.resourceID)
+	}
+	want := []string{
+		resources[0].resourceID, resources[2].resourceID, resources[3].resourceID,
+		resources[4].resourceID, resources[5].resourceID, app,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't filter power states\ngot: %v\nwant: %v", got, want)
+	}
+
+	active := map[string]bool{}
+	count := 0
+	for m := range ch {
+		count++
+		var pb dto.Metric
+		m.Write(&pb)
+		if pb.GetGauge().GetValue() == 1 {
+			labels := map[string]string{}
+			for _, l := range pb.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			active[labels["resource_name"]+" "+labels["state"]] = true
+		}
+	}
+	if count != 4*len(powerStates) {
+		t.Errorf("doesn't export every power state\ngot: %d series\nwant: %d", count, 4*len(powerStates))
+	}
+	wantActive := map[string]bool{
+		"running-vm running":              true,
+		"stopped-vm deallocated":          true,
+		"unknown-vm unknown":              true,
+		"stopped-exported-vm deallocated": true,
+	}
+	if !reflect.DeepEqual(active, wantActive) {
+		t.Errorf("doesn't export the power state of each virtual machine\ngot: %v\nwant: %v", active, wantActive)
+	}
+}
+
+func TestInheritResourceGroupTags(t *testing.T) {
+	requests := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path != "/subscriptions/"+testSubscriptionID+"/resourcegroups" {
+			t.Errorf("unexpected request for %s", r.URL.Path)
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{"value": []interface{}{
+			map[string]interface{}{"name": "Prod-RG", "tags": map[string]string{"team": "platform", "env": "prod"}},
+		}})
+	}))
+	defer srv.Close()
+	setupFakeConfig(srv.URL)
+
+	resources := []resourceMeta{
+		{
+			resourceID:    "/resourceGroups/prod-rg/providers/Microsoft.Sql/servers/sql/databases/db",
+			options:       config.SelectorOptions{InheritResourceGroupTags: true},
+			inheritedTags: map[string]string{"team": "payments"},
+		},
+		{
+			resourceID: "/resourceGroups/prod-rg/providers/Microsoft.Web/sites/app",
+			options:    config.SelectorOptions{InheritResourceGroupTags: true},
+		},
+		{resourceID: "/resourceGroups/prod-rg/providers/Microsoft.Web/sites/other"},
+	}
+
+	if err := (&Collector{}).inheritResourceGroupTags(resources); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	want := []map[string]string{
+		{"team": "payments", "env": "prod"},
+		{"team": "platform", "env": "prod"},
+		nil,
+	}
+	for i, r := range resources {
+		if !reflect.DeepEqual(r.inheritedTags, want[i]) {
+			t.Errorf("doesn't inherit resource group tags for %s\ngot: %v\nwant: %v", r.resourceID, r.inheritedTags, want[i])
+		}
+	}
+	if requests != 1 {
+		t.Errorf("doesn't cache resource groups\ngot: %d requests\nwant: 1", requests)
+	}
+}
+
+func TestAggregationSeries(t *testing.T) {
+	labels := map[string]string{"resource_name": "vm"}
+
+	var cases = []struct {
+		naming config.MetricNaming
+		want   series
+	}{
+		{
+			config.MetricNaming{},
+			series{name: "cpu_percent_total", help: "CPU, total aggregation", labels: labels, value: 2},
+		},
+		{
+			config.MetricNaming{Mode: config.NamingSuffix, Suffixes: map[string]string{"Total": "_sum"}},
+			series{name: "cpu_percent_sum", help: "CPU, total aggregation", labels: labels, value: 2},
+		},
+		{
+			config.MetricNaming{Mode: config.NamingLabel},
+			series{name: "cpu_percent", help: "CPU", labels: map[string]string{"resource_name": "vm", "aggregation": "total"}, value: 2},
+		},
+	}
+
+	for _, c := range cases {
+		sc.C = &config.Config{MetricNaming: c.naming}
+		got := aggregationSeries("cpu_percent", "CPU", labels, "Total", 2)
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("doesn't name aggregation series with %+v\ngot: %+v\nwant: %+v", c.naming, got, c.want)
+		}
+	}
+	if len(labels) != 1 {
+		t.Errorf("modified the metric labels: %v", labels)
+	}
+}
+
+func TestPlanQueries(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	vm := "/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01"
+
+	first := newMetricQuery([]config.Metric{
+		{Name: "Percentage CPU", Aggregations: []string{"Average", "Maximum"}},
+		{Name: "Network In Total", Aggregations: []string{"Total"}},
+		{Name: `Memory\Available Bytes`, MetricNamespace: "Azure.VM.Windows.GuestMetrics", Rename: "vm_available_memory_bytes"},
+	}, []string{"Average"}, nil, nil)
+	second := newMetricQuery([]config.Metric{
+		{Name: "Percentage CPU", Aggregations: []string{"Minimum"}},
+		{Name: `Process\Thread Count`},
+	}, nil, nil, nil)
+
+	resources := []resourceMeta{
+		{resourceID: vm, metrics: first.metrics, aggregations: first.aggregations, metricOptions: first.options},
+		{resourceID: vm, metricNamespace: "Azure.VM.Windows.GuestMetrics", metrics: second.metrics, aggregations: second.aggregations, metricOptions: second.options},
+		{resourceID: vm, metrics: second.metrics, aggregations: second.aggregations, metricOptions: second.options},
+	}
+
+	var got []string
+	for _, q := range planQueries(resources) {
+		got = append(got, q.metricNamespace+" | "+q.metrics+" | "+strings.Join(q.aggregations, ","))
+	}
+	want := []string{
+		" | Percentage CPU,Network In Total,Process\\Thread Count | Average,Maximum,Total,Minimum",
+		"Azure.VM.Windows.GuestMetrics | Memory\\Available Bytes,Percentage CPU,Process\\Thread Count | Average,Minimum,Total,Maximum",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't group metrics into queries\ngot: %q\nwant: %q", got, want)
+	}
+
+	planned := planQueries(resources)
+	cpu := planned[0].metricOptions["percentage cpu"]
+	if !reflect.DeepEqual(cpu.Aggregations, []string{"Average", "Maximum", "Minimum"}) {
+		t.Errorf("doesn't merge metric aggregations\ngot: %v", cpu.Aggregations)
+	}
+	memory := planned[1].metricOptions[`memory\available bytes`]
+	if memory.Rename != "vm_available_memory_bytes" || !reflect.DeepEqual(memory.Aggregations, []string{"Average"}) {
+		t.Errorf("doesn't keep metric settings\ngot: %+v", memory)
+	}
+	if !strings.Contains(planned[1].resourceURL, "metricnamespace=Azure.VM.Windows.GuestMetrics") {
+		t.Errorf("doesn't query metric namespace\ngot: %v", planned[1].resourceURL)
+	}
+
+	var metrics []config.Metric
+	for i := 0; i < 45; i++ {
+		metrics = append(metrics, config.Metric{Name: fmt.Sprintf("metric-%d", i)})
+	}
+	many := newMetricQuery(metrics, nil, nil, nil)
+	planned = planQueries([]resourceMeta{{resourceID: vm, metrics: many.metrics, aggregations: many.aggregations, metricOptions: many.options}})
+	var sizes []int
+	for _, q := range planned {
+		sizes = append(sizes, len(strings.Split(q.metrics, ",")))
+	}
+	if !reflect.DeepEqual(sizes, []int{20, 20, 5}) {
+		t.Errorf("doesn't split queries\ngot: %v", sizes)
+	}
+}
+
+func TestExtractMetricsOverrides(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	vm := "/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01"
+	q := newMetricQuery([]config.Metric{
+		{Name: "Percentage CPU", Aggregations: []string{"Maximum"}, Rename: "vm_cpu_percent", Help: "CPU usage"},
+		{Name: "Network In Total"},
+	}, []string{"Total"}, nil, nil)
+	rm := resourceMeta{resourceID: vm, metrics: q.metrics, aggregations: q.aggregations, metricOptions: q.options}
+	rm.resourceURL = resourceURLFrom(vm, "", rm.metrics, rm.aggregations)
+
+	var data AzureMetricValueResponse
+	err := json.Unmarshal([]byte(`{"value": [
+		{"name": {"value": "Percentage CPU"}, "unit": "Percent", "timeseries": [{"data": [{"total": 1, "maximum": 2}]}]},
+		{"name": {"value": "Network In Total"}, "unit": "Bytes", "timeseries": [{"data": [{"total": 3, "maximum": 4}]}]}
+	]}`), &data)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	(&Collector{}).extractMetrics(newSeriesWriter(ch, nil), newRollupSet(), rm, 200, data)
+	close(ch)
+
+	got := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		desc := m.Desc().String()
+		got[desc[strings.Index(desc, `fqName: "`)+9:strings.Index(desc, `", help`)]] = pb.GetGauge().GetValue()
+		if strings.Contains(desc, "vm_cpu_percent") && !strings.Contains(desc, `help: "CPU usage, maximum aggregation"`) {
+			t.Errorf("doesn't use metric help\ngot: %v", desc)
+		}
+	}
+	want := map[string]float64{"vm_cpu_percent_max": 2, "network_in_total_bytes_total": 3}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't apply metric settings\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestResolveMetrics(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	ac.definitions = newMetricDefinitionCache()
+	var definitions AzureMetricDefinitionResponse
+	err := json.Unmarshal([]byte(`{"value": [
+		{"name": {"value": "Percentage CPU"}, "primaryAggregationType": "Average"},
+		{"name": {"value": "Network In Total"}, "primaryAggregationType": "Total"},
+		{"name": {"value": "Disk Read Bytes"}, "primaryAggregationType": "Total"}
+	]}`), &definitions)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	ac.definitions.store(definitionsKeyFor("Microsoft.Compute/virtualMachines", ""), definitions.MetricDefinitionResponses, time.Now())
+
+	var selectors []config.ResourceType
+	err = yaml.Unmarshal([]byte(`
+- resource_types: [Microsoft.Compute/virtualMachines]
+  metrics: all
+  metric_name_exclude_re: ["Disk.*"]
+- resource_types: [Microsoft.Compute/virtualMachines]
+  metrics:
+  - name: Percentage CPU
+    aggregations: [Maximum]
+  metric_name_include_re: ["Disk.*"]
+  aggregations: [Minimum]
+`), &selectors)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	vm := "/resourceGroups/rg/providers/Microsoft.Compute/virtualMachines/vm"
+	var resources []resourceMeta
+	for _, s := range selectors {
+		q := newMetricQuery(s.Metrics, s.Aggregations, s.MetricNameIncludeRe, s.MetricNameExcludeRe)
+		resources = append(resources, resourceMeta{
+			resourceID:    vm,
+			resourceURL:   resourceURLFrom(vm, "", q.metrics, q.aggregations),
+			metrics:       q.metrics,
+			aggregations:  q.aggregations,
+			metricOptions: q.options,
+			metricFilters: q.filters,
+		})
+	}
+
+	got := map[string][]string{}
+	for _, rm := range resolveMetrics(resources) {
+		for _, name := range strings.Split(rm.metrics, ",") {
+			got[name] = append(got[name], strings.Join(rm.metricOptions[strings.ToLower(name)].Aggregations, ","))
+		}
+	}
+	want := map[string][]string{
+		"Network In Total": {"Total"},
+		"Percentage CPU":   {"Average", "Maximum"},
+		"Disk Read Bytes":  {"Minimum"},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't resolve metrics from definitions\ngot: %v\nwant: %v", got, want)
+	}
+}
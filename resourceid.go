@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// ResourceID is a parsed Azure Resource Manager resource ID, e.g.
+// /subscriptions/{id}/resourceGroups/{rg}/providers/Microsoft.Sql/servers/{server}/databases/{db}
+type ResourceID struct {
+	SubscriptionID string
+	ResourceGroup  string
+	// Namespace is the resource provider namespace, e.g. Microsoft.Sql.
+	Namespace string
+	// Types and Names hold the type chain and name chain of the resource, parent first,
+	// e.g. [servers databases] and [{server} {db}].
+	Types []string
+	Names []string
+	// Scope is the resource an extension resource is attached to, e.g. the virtual machine
+	// of .../virtualMachines/{vm}/providers/Microsoft.Insights/diagnosticSettings/{name}.
+	Scope *ResourceID
+}
+
+// ParseResourceID parses a resource ID. The subscription and resource group parts are optional,
+// so IDs relative to the configured subscription can be parsed as well.
+func ParseResourceID(resourceID string) (*ResourceID, error) {
+	var segments []string
+	for _, s := range strings.Split(resourceID, "/") {
+		if s != "" {
+			segments = append(segments, s)
+		}
+	}
+
+	id := &ResourceID{}
+	i := 0
+	if i+1 < len(segments) && strings.EqualFold(segments[i], "subscriptions") {
+		id.SubscriptionID = segments[i+1]
+		i += 2
+	}
+	if i+1 < len(segments) && strings.EqualFold(segments[i], "resourceGroups") {
+		id.ResourceGroup = segments[i+1]
+		i += 2
+	}
+
+	for i < len(segments) {
+		if !strings.EqualFold(segments[i], "providers") || i+1 >= len(segments) {
+			return nil, fmt.Errorf("Invalid resource ID %q: expected providers/{namespace} at %q", resourceID, strings.Join(segments[i:], "/"))
+		}
+
+		// A resource below another provider segment is an extension of the resource before it.
+		if id.Namespace != "" {
+			scope := *id
+			id = &ResourceID{
+				SubscriptionID: scope.SubscriptionID,
+				ResourceGroup:  scope.ResourceGroup,
+				Scope:          &scope,
+			}
+		}
+		id.Namespace = segments[i+1]
+		i += 2
+
+		for i < len(segments) && !strings.EqualFold(segments[i], "providers") {
+			if i+1 >= len(segments) {
+				return nil, fmt.Errorf("Invalid resource ID %q: no name for type %q", resourceID, segments[i])
+			}
+			id.Types = append(id.Types, segments[i])
+			id.Names = append(id.Names, segments[i+1])
+			i += 2
+		}
+		if len(id.Types) == 0 {
+			return nil, fmt.Errorf("Invalid resource ID %q: no resource type for namespace %q", resourceID, id.Namespace)
+		}
+	}
+
+	if id.SubscriptionID == "" && id.ResourceGroup == "" && id.Namespace == "" {
+		return nil, fmt.Errorf("Invalid resource ID %q", resourceID)
+	}
+	return id, nil
+}
+
+// parseResourceURL parses the resource ID of a metrics URL built by resourceURLFrom.
+func parseResourceURL(resourceURL string) (*ResourceID, error) {
+	if i := strings.Index(resourceURL, "?"); i >= 0 {
+		resourceURL = resourceURL[:i]
+	}
+	suffix := "/providers/microsoft.insights/metrics"
+	if strings.HasSuffix(strings.ToLower(resourceURL), suffix) {
+		resourceURL = resourceURL[:len(resourceURL)-len(suffix)]
+	}
+	return ParseResourceID(resourceURL)
+}
+
+// Type returns the full resource type, e.g. Microsoft.Sql/servers/databases.
+func (id *ResourceID) Type() string {
+	if id.Namespace == "" {
+		return ""
+	}
+	return strings.Join(append([]string{id.Namespace}, id.Types...), "/")
+}
+
+// Name returns the name of the resource itself, e.g. the database name of a SQL database.
+func (id *ResourceID) Name() string {
+	if len(id.Names) == 0 {
+		return ""
+	}
+	return id.Names[len(id.Names)-1]
+}
+
+// String returns the full resource ID.
+func (id *ResourceID) String() string {
+	var str strings.Builder
+	if id.Scope != nil {
+		str.WriteString(id.Scope.String())
+	} else {
+		if id.SubscriptionID != "" {
+			str.WriteString("/subscriptions/" + id.SubscriptionID)
+		}
+		if id.ResourceGroup != "" {
+			str.WriteString("/resourceGroups/" + id.ResourceGroup)
+		}
+	}
+	if id.Namespace != "" {
+		str.WriteString("/providers/" + id.Namespace)
+		for i := range id.Types {
+			str.WriteString("/" + id.Types[i] + "/" + id.Names[i])
+		}
+	}
+	return str.String()
+}
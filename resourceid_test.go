@@ -0,0 +1,152 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseResourceID(t *testing.T) {
+	var cases = []struct {
+		id   string
+		want ResourceID
+		typ  string
+		name string
+	}{
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+			ResourceID{
+				SubscriptionID: "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6",
+				ResourceGroup:  "prod-rg-001",
+				Namespace:      "Microsoft.Compute",
+				Types:          []string{"virtualMachines"},
+				Names:          []string{"prod-vm-01"},
+			},
+			"Microsoft.Compute/virtualMachines",
+			"prod-vm-01",
+		},
+		{
+			"/resourceGroups/prod-rg-002/providers/Microsoft.Sql/servers/sqlprod/databases/prod-db-01",
+			ResourceID{
+				ResourceGroup: "prod-rg-002",
+				Namespace:     "Microsoft.Sql",
+				Types:         []string{"servers", "databases"},
+				Names:         []string{"sqlprod", "prod-db-01"},
+			},
+			"Microsoft.Sql/servers/databases",
+			"prod-db-01",
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourcegroups/storage/providers/Microsoft.Storage/storageAccounts/prodstorage/blobServices/default/containers/logs",
+			ResourceID{
+				SubscriptionID: "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6",
+				ResourceGroup:  "storage",
+				Namespace:      "Microsoft.Storage",
+				Types:          []string{"storageAccounts", "blobServices", "containers"},
+				Names:          []string{"prodstorage", "default", "logs"},
+			},
+			"Microsoft.Storage/storageAccounts/blobServices/containers",
+			"logs",
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/providers/Microsoft.Security/pricings/VirtualMachines",
+			ResourceID{
+				SubscriptionID: "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6",
+				Namespace:      "Microsoft.Security",
+				Types:          []string{"pricings"},
+				Names:          []string{"VirtualMachines"},
+			},
+			"Microsoft.Security/pricings",
+			"VirtualMachines",
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001",
+			ResourceID{
+				SubscriptionID: "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6",
+				ResourceGroup:  "prod-rg-001",
+			},
+			"",
+			"",
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01/providers/Microsoft.Insights/diagnosticSettings/send-to-la",
+			ResourceID{
+				SubscriptionID: "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6",
+				ResourceGroup:  "prod-rg-001",
+				Namespace:      "Microsoft.Insights",
+				Types:          []string{"diagnosticSettings"},
+				Names:          []string{"send-to-la"},
+				Scope: &ResourceID{
+					SubscriptionID: "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6",
+					ResourceGroup:  "prod-rg-001",
+					Namespace:      "Microsoft.Compute",
+					Types:          []string{"virtualMachines"},
+					Names:          []string{"prod-vm-01"},
+				},
+			},
+			"Microsoft.Insights/diagnosticSettings",
+			"send-to-la",
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/web/providers/Microsoft.Web/sites/shop/slots/staging",
+			ResourceID{
+				SubscriptionID: "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6",
+				ResourceGroup:  "web",
+				Namespace:      "Microsoft.Web",
+				Types:          []string{"sites", "slots"},
+				Names:          []string{"shop", "staging"},
+			},
+			"Microsoft.Web/sites/slots",
+			"staging",
+		},
+	}
+
+	for _, c := range cases {
+		got, err := ParseResourceID(c.id)
+		if err != nil {
+			t.Errorf("unexpected error parsing %s: %v", c.id, err)
+			continue
+		}
+		if !reflect.DeepEqual(*got, c.want) {
+			t.Errorf("doesn't parse resource ID %s\ngot: %+v\nwant: %+v", c.id, *got, c.want)
+		}
+		if got.Type() != c.typ {
+			t.Errorf("doesn't return expected type for %s\ngot: %v\nwant: %v", c.id, got.Type(), c.typ)
+		}
+		if got.Name() != c.name {
+			t.Errorf("doesn't return expected name for %s\ngot: %v\nwant: %v", c.id, got.Name(), c.name)
+		}
+		if !strings.EqualFold(got.String(), c.id) {
+			t.Errorf("doesn't format resource ID back\ngot: %v\nwant: %v", got.String(), c.id)
+		}
+	}
+}
+
+func TestParseResourceIDInvalid(t *testing.T) {
+	var cases = []string{
+		"",
+		"/",
+		"prod-vm-01",
+		"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute",
+		"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines",
+		"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/virtualMachines/prod-vm-01",
+	}
+
+	for _, c := range cases {
+		if id, err := ParseResourceID(c); err == nil {
+			t.Errorf("expected error parsing %q, got %+v", c, *id)
+		}
+	}
+}
+
+func TestParseResourceURL(t *testing.T) {
+	url := "/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01/providers/microsoft.insights/metrics?aggregation=Total&api-version=2018-01-01"
+
+	id, err := parseResourceURL(url)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if id.Type() != "Microsoft.Compute/virtualMachines" || id.Name() != "prod-vm-01" || id.Scope != nil {
+		t.Errorf("doesn't parse resource URL\ngot: %+v", *id)
+	}
+}
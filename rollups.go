@@ -0,0 +1,114 @@
+package main
+
+import (
+	"github.com/prometheus/common/model"
+)
+
+// rollup accumulates the series of the resources of a group into one series.
+type rollup struct {
+	series      series
+	aggregation string
+	n           int
+	sum         float64
+	// weighted and count accumulate the averages weighted by their sample count.
+	weighted float64
+	count    float64
+	// unweighted is set when an average came without sample count, the plain mean is used then.
+	unweighted bool
+}
+
+// add adds the value of a resource, with its sample count if it was queried.
+func (r *rollup) add(value float64, count *float64) {
+	switch r.aggregation {
+	case "Minimum":
+		if r.n == 0 || value < r.sum {
+			r.sum = value
+		}
+	case "Maximum":
+		if r.n == 0 || value > r.sum {
+			r.sum = value
+		}
+	default:
+		r.sum += value
+	}
+	if count != nil {
+		r.weighted += value * *count
+		r.count += *count
+	} else {
+		r.unweighted = true
+	}
+	r.n++
+}
+
+func (r *rollup) value() float64 {
+	if r.aggregation != "Average" {
+		return r.sum
+	}
+	if !r.unweighted && r.count > 0 {
+		return r.weighted / r.count
+	}
+	return r.sum / float64(r.n)
+}
+
+// rollupSet holds the rollup groups of a scrape, in the order they were first seen.
+type rollupSet struct {
+	groups map[model.Fingerprint]*rollup
+	order  []model.Fingerprint
+}
+
+func newRollupSet() *rollupSet {
+	return &rollupSet{groups: make(map[model.Fingerprint]*rollup)}
+}
+
+// add adds the series of a resource to the group with the same name and labels. Totals are summed,
+// averages are weighted by their sample count when it was queried, minimums and maximums are kept.
+func (rs *rollupSet) add(s series, aggregation string, count *float64) {
+	labelSet := model.LabelSet{model.MetricNameLabel: model.LabelValue(s.name)}
+	for k, v := range s.labels {
+		labelSet[model.LabelName(k)] = model.LabelValue(v)
+	}
+	fingerprint := labelSet.Fingerprint()
+
+	r, ok := rs.groups[fingerprint]
+	if !ok {
+		r = &rollup{series: s, aggregation: aggregation}
+		rs.groups[fingerprint] = r
+		rs.order = append(rs.order, fingerprint)
+	}
+	r.add(s.value, count)
+}
+
+// series returns the aggregated series of each group.
+func (rs *rollupSet) series() []series {
+	var aggregated []series
+	for _, fingerprint := range rs.order {
+		r := rs.groups[fingerprint]
+		s := r.series
+		s.value = r.value()
+		aggregated = append(aggregated, s)
+	}
+	return aggregated
+}
+
+// rollupLabels returns the labels of a resource to group it by: the labels of its metric series,
+// its location and all its tags as tag_* labels. Missing labels are empty.
+func rollupLabels(rm resourceMeta, by []string) map[string]string {
+	available := CreateMetricLabels(rm)
+	for tag, value := range rm.inheritedTags {
+		if _, ok := available[tagLabelName(tag)]; !ok {
+			available[tagLabelName(tag)] = value
+		}
+	}
+	for tag, value := range rm.resource.Tags {
+		available[tagLabelName(tag)] = value
+	}
+	if _, ok := available["location"]; !ok {
+		available["location"] = rm.resource.Location
+	}
+
+	labels := make(map[string]string, len(by))
+	for _, name := range by {
+		labels[name] = available[name]
+	}
+	return labels
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestRollupSet(t *testing.T) {
+	var cases = []struct {
+		aggregation string
+		values      []float64
+		counts      []float64
+		want        float64
+	}{
+		{"Total", []float64{1, 2, 3}, nil, 6},
+		{"Minimum", []float64{2, 1, 3}, nil, 1},
+		{"Maximum", []float64{2, 3, 1}, nil, 3},
+		// averages are weighted by their sample count
+		{"Average", []float64{10, 40}, []float64{3, 1}, 17.5},
+		// plain mean when the count was not queried
+		{"Average", []float64{10, 40}, nil, 25},
+	}
+
+	for _, c := range cases {
+		rs := newRollupSet()
+		for i, v := range c.values {
+			var count *float64
+			if c.counts != nil {
+				count = &c.counts[i]
+			}
+			rs.add(series{name: "m", labels: map[string]string{"resource_group": "rg"}, value: v}, c.aggregation, count)
+		}
+		got := rs.series()
+		if len(got) != 1 || got[0].value != c.want {
+			t.Errorf("doesn't roll up %s of %v\ngot: %v\nwant: %v", c.aggregation, c.values, got, c.want)
+		}
+	}
+
+	rs := newRollupSet()
+	rs.add(series{name: "m", labels: map[string]string{"resource_group": "a"}, value: 1}, "Total", nil)
+	rs.add(series{name: "m", labels: map[string]string{"resource_group": "b"}, value: 2}, "Total", nil)
+	if got := rs.series(); len(got) != 2 {
+		t.Errorf("doesn't keep groups apart\ngot: %v", got)
+	}
+}
+
+func TestExtractMetricsRollups(t *testing.T) {
+	setupFakeConfig("https://management.azure.com")
+	rollups := []config.Rollup{{By: []string{"tag_team", "location"}}}
+	q := newMetricQuery([]config.Metric{{Name: "Requests"}, {Name: "CpuTime"}}, []string{"Total", "Average", "Minimum"}, nil, nil)
+
+	var resources []resourceMeta
+	for _, app := range []struct{ rg, name, team string }{{"rg-1", "app-1", "web"}, {"rg-2", "app-2", "web"}, {"rg-2", "app-3", "api"}, {"rg-3", "app-4", "api"}} {
+		id := "/resourceGroups/" + app.rg + "/providers/Microsoft.Web/sites/" + app.name
+		rm := resourceMeta{resourceID: id, metrics: q.metrics, aggregations: q.aggregations, metricOptions: q.options}
+		rm.resource = AzureResource{ID: id, Location: "westeurope", Tags: map[string]string{"Team": app.team}}
+		rm.options.Rollups = rollups
+		rm.resourceURL = resourceURLFrom(id, "", rm.metrics, queryAggregations(rm))
+		resources = append(resources, rm)
+	}
+	if !strings.Contains(resources[0].resourceURL, "aggregation=Total%2CAverage%2CMinimum%2CCount") {
+		t.Errorf("doesn't query the sample count\ngot: %v", resources[0].resourceURL)
+	}
+
+	responses := []string{
+		`{"value": [{"name": {"value": "Requests"}, "unit": "Count", "timeseries": [{"data": [{"total": 10, "average": 1, "count": 1}]}]}]}`,
+		`{"value": [{"name": {"value": "Requests"}, "unit": "Count", "timeseries": [{"data": [{"total": 20, "average": 4, "count": 3}]}]}]}`,
+		`{"value": [{"name": {"value": "Requests"}, "unit": "Count", "timeseries": [{"data": [{"total": 5, "average": 2, "minimum": 1, "count": 1}]}]}]}`,
+		// a bucket without samples is skipped
+		`{"value": [{"name": {"value": "Requests"}, "unit": "Count", "timeseries": [{"data": [{"total": 0, "average": 0, "minimum": 0, "count": 0}]}]}]}`,
+	}
+
+	ch := make(chan prometheus.Metric, 20)
+	w := newSeriesWriter(ch, nil)
+	rs := newRollupSet()
+	for i, rm := range resources {
+		var data AzureMetricValueResponse
+		if err := json.Unmarshal([]byte(responses[i]), &data); err != nil {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		(&Collector{}).extractMetrics(w, rs, rm, 200, data)
+	}
+	for _, s := range rs.series() {
+		w.write(s)
+	}
+	close(ch)
+
+	got := map[string]float64{}
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		desc := m.Desc().String()
+		name := desc[strings.Index(desc, `fqName: "`)+9 : strings.Index(desc, `", help`)]
+		if !strings.HasPrefix(name, "requests_") {
+			continue
+		}
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if !reflect.DeepEqual(labels, map[string]string{"tag_team": labels["tag_team"], "location": "westeurope"}) {
+			t.Errorf("doesn't group by the rollup labels only\ngot: %v", labels)
+		}
+		got[name+"{"+labels["tag_team"]+"}"] = pb.GetGauge().GetValue()
+	}
+	want := map[string]float64{
+		"requests_count_total{web}":   30,
+		"requests_count_average{web}": 3.25,
+		"requests_count_total{api}":   5,
+		"requests_count_average{api}": 2,
+		"requests_count_min{api}":     1,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't roll up series\ngot: %v\nwant: %v", got, want)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/common/model"
+)
+
+// series is a sample built from Azure data, before metric_relabel_configs are applied.
+type series struct {
+	name   string
+	help   string
+	labels map[string]string
+	value  float64
+	// valueType defaults to a gauge.
+	valueType prometheus.ValueType
+	// timestamp is the time of the sample, the scrape time when zero.
+	timestamp time.Time
+	// selector is set on the metric series of a resource to the selector of the resource, they are counted
+	// against the max_series limits. Other series, e.g. the inventory or rollups, are not limited.
+	selector string
+}
+
+// seriesWriter applies the metric relabel configs to series and sends the remaining ones to Prometheus.
+type seriesWriter struct {
+	ch      chan<- prometheus.Metric
+	relabel []*config.RelabelConfig
+	// written holds the fingerprints of the series sent during this scrape.
+	written map[model.Fingerprint]bool
+	// help holds the help text of each metric name sent, as all series of a metric must share it.
+	help map[string]string
+	// maxSeries limits the number of metric series sent, globally and for the selectors in selectorMaxSeries,
+	// 0 is unlimited. exceeded holds the selectors, or globalSelector, whose series were dropped.
+	maxSeries         int
+	selectorMaxSeries map[string]int
+	exceeded          map[string]bool
+	// metricSeries counts the metric series sent, per selector and under globalSelector.
+	metricSeries map[string]int
+}
+
+func newSeriesWriter(ch chan<- prometheus.Metric, relabel []*config.RelabelConfig) *seriesWriter {
+	return &seriesWriter{
+		ch:      ch,
+		relabel: relabel,
+		written: make(map[model.Fingerprint]bool),
+		help:    make(map[string]string),
+
+		selectorMaxSeries: make(map[string]int),
+		exceeded:          make(map[string]bool),
+		metricSeries:      make(map[string]int),
+	}
+}
+
+// write relabels a series and sends it, unless it was dropped or a series with the
+// same name and labels was already sent.
+func (w *seriesWriter) write(s series) {
+	labels := make(map[string]string, len(s.labels)+1)
+	for k, v := range s.labels {
+		labels[k] = v
+	}
+	labels[model.MetricNameLabel] = s.name
+
+	labels = config.Relabel(labels, w.relabel)
+	if labels == nil {
+		return
+	}
+
+	name := labels[model.MetricNameLabel]
+	if !model.IsValidMetricName(model.LabelValue(name)) {
+		log.Printf("Dropping series with invalid metric name %q after relabeling", name)
+		return
+	}
+
+	labelSet := model.LabelSet{}
+	for k, v := range labels {
+		if k != model.MetricNameLabel && strings.HasPrefix(k, model.ReservedLabelPrefix) {
+			delete(labels, k)
+			continue
+		}
+		if !model.LabelName(k).IsValid() {
+			log.Printf("Dropping series %s with invalid label name %q after relabeling", name, k)
+			return
+		}
+		labelSet[model.LabelName(k)] = model.LabelValue(v)
+	}
+	delete(labels, model.MetricNameLabel)
+
+	fingerprint := labelSet.Fingerprint()
+	if w.written[fingerprint] {
+		log.Printf("Dropping duplicate series %s after relabeling", labelSet)
+		return
+	}
+	if s.selector != "" {
+		if max := w.selectorMaxSeries[s.selector]; max > 0 && w.metricSeries[s.selector] >= max {
+			w.exceed(s.selector, max)
+			return
+		}
+		if w.maxSeries > 0 && w.metricSeries[globalSelector] >= w.maxSeries {
+			w.exceed(globalSelector, w.maxSeries)
+			return
+		}
+		w.metricSeries[s.selector]++
+		w.metricSeries[globalSelector]++
+	}
+	w.written[fingerprint] = true
+
+	help, ok := w.help[name]
+	if !ok {
+		help = s.help
+		w.help[name] = help
+	}
+
+	valueType := s.valueType
+	if valueType == 0 {
+		valueType = prometheus.GaugeValue
+	}
+
+	m := prometheus.MustNewConstMetric(
+		prometheus.NewDesc(name, help, nil, labels),
+		valueType,
+		s.value,
+	)
+	if !s.timestamp.IsZero() {
+		m = prometheus.NewMetricWithTimestamp(s.timestamp, m)
+	}
+	w.ch <- m
+}
+
+// exceed records that a max_series limit dropped series, logging it the first time.
+func (w *seriesWriter) exceed(selector string, max int) {
+	if !w.exceeded[selector] {
+		log.Printf("Selector %s exceeded its max_series of %d, dropping the remaining series", selector, max)
+	}
+	w.exceeded[selector] = true
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	yaml "gopkg.in/yaml.v2"
+)
+
+func TestSeriesWriter(t *testing.T) {
+	var relabel []*config.RelabelConfig
+	err := yaml.Unmarshal([]byte(`
+- source_labels: [__name__]
+  regex: "debug_.*"
+  action: drop
+- regex: "dimension_.*"
+  action: labeldrop
+- source_labels: [__name__]
+  regex: "(.*)_average"
+  target_label: __name__
+- source_labels: [resource_name]
+  target_label: __tmp
+`), &relabel)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	ch := make(chan prometheus.Metric, 10)
+	w := newSeriesWriter(ch, relabel)
+	w.write(series{name: "cpu_average", help: "cpu", labels: map[string]string{"resource_name": "vm", "dimension_lun": "1"}, value: 1})
+	w.write(series{name: "cpu_average", help: "cpu", labels: map[string]string{"resource_name": "vm", "dimension_lun": "2"}, value: 2})
+	w.write(series{name: "debug_average", help: "debug", labels: map[string]string{"resource_name": "vm"}, value: 3})
+	close(ch)
+
+	var got []string
+	for m := range ch {
+		var pb dto.Metric
+		m.Write(&pb)
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		if !reflect.DeepEqual(labels, map[string]string{"resource_name": "vm"}) {
+			t.Errorf("doesn't relabel series\ngot: %v", labels)
+		}
+		got = append(got, m.Desc().String())
+	}
+	if len(got) != 1 {
+		t.Fatalf("doesn't drop relabeled duplicates\ngot: %v", got)
+	}
+	if !strings.Contains(got[0], `fqName: "cpu"`) {
+		t.Errorf("doesn't rename series\ngot: %v", got[0])
+	}
+}
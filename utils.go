@@ -8,17 +8,12 @@ import (
 	"regexp"
 	"strings"
 	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
 )
 
 var (
-	// resource component positions in a ResourceURL
-	resourceGroupPosition      = 4
-	resourceNamePosition       = 8
-	subResourceNamePosition    = 10
-	resourceTypeSuffixPosition = 9
-	resourceTypePosition       = 7
-	resourceTypePrefixPosition = 6
-	invalidLabelChars          = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
+	invalidLabelChars = regexp.MustCompile(`[^a-zA-Z0-9_]+`)
 )
 
 // PrintPrettyJSON - Prints structs nicely for debugging.
@@ -36,36 +31,175 @@ func GetTimes() (string, string) {
 	now := time.Now().UTC()
 
 	// Use query delay of 3 minutes when querying for latest metric data
-	endTime := now.Add(time.Minute * time.Duration(-3)).Format(time.RFC3339)
-	startTime := now.Add(time.Minute * time.Duration(-4)).Format(time.RFC3339)
+	end := now.Add(time.Minute * time.Duration(-3))
+	endTime := end.Format(time.RFC3339)
+	startTime := end.Add(-queryWindow()).Format(time.RFC3339)
 	return endTime, startTime
 }
 
+// queryWindow returns how far back metrics are queried. The latest value is exported, except by
+// counters which need every time bucket since the previous scrape and by late data re-exports.
+func queryWindow() time.Duration {
+	window := time.Minute
+	if sc.C.TotalCounters.Enabled && sc.C.TotalCounters.LookbackOrDefault() > window {
+		window = sc.C.TotalCounters.LookbackOrDefault()
+	}
+	if sc.C.LateData.Enabled && sc.C.LateData.LookbackOrDefault() > window {
+		window = sc.C.LateData.LookbackOrDefault()
+	}
+	return window
+}
+
+// fullResourceID returns the ID of a resource including its subscription.
+// IDs not starting with /subscriptions/ are relative to the configured subscription.
+func fullResourceID(resourceID string) string {
+	if strings.HasPrefix(strings.ToLower(resourceID), "/subscriptions/") {
+		return resourceID
+	}
+	return fmt.Sprintf("/subscriptions/%s%s", sc.C.Credentials.SubscriptionID, resourceID)
+}
+
+// relativeResourceID strips the configured subscription from a full resource ID.
+// IDs of resources in other subscriptions are returned unchanged.
+func relativeResourceID(resourceID string) string {
+	prefix := fmt.Sprintf("/subscriptions/%s/", sc.C.Credentials.SubscriptionID)
+	if len(resourceID) >= len(prefix) && strings.EqualFold(resourceID[:len(prefix)], prefix) {
+		return resourceID[len(prefix)-1:]
+	}
+	return resourceID
+}
+
+// subscriptionFrom returns the subscription ID from a resource ID.
+// IDs not starting with /subscriptions/ are relative to the configured subscription.
+func subscriptionFrom(resourceID string) string {
+	id, err := ParseResourceID(fullResourceID(resourceID))
+	if err != nil {
+		return ""
+	}
+	return id.SubscriptionID
+}
+
+// resourceGroupFrom returns the name of the resource group from a resource ID.
+func resourceGroupFrom(resourceID string) string {
+	id, err := ParseResourceID(resourceID)
+	if err != nil {
+		return ""
+	}
+	return id.ResourceGroup
+}
+
+// hasLocation reports whether location is one of locations. Locations are compared
+// case-insensitively and ignoring spaces, so "West Europe" matches "westeurope".
+func hasLocation(locations []string, location string) bool {
+	normalize := func(l string) string {
+		return strings.ToLower(strings.Replace(l, " ", "", -1))
+	}
+	for _, l := range locations {
+		if normalize(l) == normalize(location) {
+			return true
+		}
+	}
+	return false
+}
+
 // CreateResourceLabels - Returns resource labels for a given resource URL.
+// Names of nested resources below the top-level resource are joined in sub_resource_name.
 func CreateResourceLabels(resourceURL string) map[string]string {
-	labels := make(map[string]string)
-	resource := strings.Split(resourceURL, "/")
+	labels := map[string]string{
+		"resource_group": "",
+		"resource_name":  "",
+	}
+	id, err := parseResourceURL(resourceURL)
+	if err != nil {
+		log.Println(err)
+		return labels
+	}
+
+	labels["resource_group"] = id.ResourceGroup
+	if len(id.Names) > 0 {
+		labels["resource_name"] = id.Names[0]
+	}
+	if len(id.Names) > 1 {
+		labels["sub_resource_name"] = strings.Join(id.Names[1:], "/")
+	}
+	return labels
+}
 
-	labels["resource_group"] = resource[resourceGroupPosition]
-	labels["resource_name"] = resource[resourceNamePosition]
-	if len(resource) > 13 {
-		labels["sub_resource_name"] = resource[subResourceNamePosition]
+// CreateMetricLabels - Returns the labels of every metric series of a resource: its resource labels,
+// the name of its parent resource, the tags listed in tag_labels and the labels configured on its selector,
+// rendered against the resource. Tags missing from the resource are taken from its inherited tags.
+func CreateMetricLabels(rm resourceMeta) map[string]string {
+	labels := CreateResourceLabels(rm.resourceURL)
+	if rm.parentResourceName != "" {
+		labels["parent_resource_name"] = rm.parentResourceName
+	}
+
+	tagLabels := sc.C.TagLabels
+	if len(rm.options.TagLabels) > 0 {
+		tagLabels = rm.options.TagLabels
+	}
+	for _, tag := range tagLabels {
+		value, ok := config.LookupTag(rm.resource.Tags, tag)
+		if !ok {
+			value, _ = config.LookupTag(rm.inheritedTags, tag)
+		}
+		labels[tagLabelName(tag)] = value
+	}
+
+	for name, tmpl := range rm.options.Labels {
+		var value strings.Builder
+		if err := tmpl.Execute(&value, rm.resource); err != nil {
+			log.Printf("Error rendering label %s for resource %s: %v", name, rm.resourceID, err)
+			continue
+		}
+		labels[name] = value.String()
 	}
 	return labels
 }
 
+type baseUnit struct {
+	suffix string
+	scale  float64
+}
+
+// baseUnits maps Azure units to the Prometheus base unit suffix and the scale converting values to it.
+var baseUnits = map[string]baseUnit{
+	"milliseconds":   {"seconds", 0.001},
+	"seconds":        {"seconds", 1},
+	"percent":        {"ratio", 0.01},
+	"bytes":          {"bytes", 1},
+	"bytespersecond": {"bytes_per_second", 1},
+	"bitspersecond":  {"bytes_per_second", 0.125},
+	"countpersecond": {"per_second", 1},
+}
+
+// metricNameFrom builds a Prometheus metric name from an Azure metric and its unit. With normalizeUnits,
+// units with a Prometheus base unit are named after it and the returned scale converts values to it.
+func metricNameFrom(metricNamespace string, metric string, unit string, normalizeUnits bool) (string, float64) {
+	scale := 1.0
+	unitSuffix := unit
+	if u, ok := baseUnits[strings.ToLower(unit)]; ok && normalizeUnits {
+		unitSuffix = u.suffix
+		scale = u.scale
+	}
+
+	// Ensure Azure metric names conform to Prometheus metric name conventions
+	metricName := strings.Replace(metric, " ", "_", -1)
+	metricName = strings.ToLower(metricName + "_" + unitSuffix)
+	metricName = strings.Replace(metricName, "/", "_per_", -1)
+	if metricNamespace != "" {
+		metricName = strings.ToLower(metricNamespace + "_" + metricName)
+	}
+	return invalidMetricChars.ReplaceAllString(metricName, "_"), scale
+}
+
 // GetResourceType returns the resource type with the namespace
 func GetResourceType(resourceURL string) string {
-	resource := strings.Split(resourceURL, "/")
-	var str strings.Builder
-	str.WriteString(resource[resourceTypePrefixPosition])
-	str.WriteString("/")
-	str.WriteString(resource[resourceTypePosition])
-	if len(resource) > 13 {
-		str.WriteString("/")
-		str.WriteString(resource[resourceTypeSuffixPosition])
+	id, err := parseResourceURL(resourceURL)
+	if err != nil {
+		return ""
 	}
-	return str.String()
+	return id.Type()
 }
 
 func CreateAllResourceLabelsFrom(rm resourceMeta) map[string]string {
@@ -73,10 +207,7 @@ func CreateAllResourceLabelsFrom(rm resourceMeta) map[string]string {
 	labels := make(map[string]string)
 
 	for k, v := range rm.resource.Tags {
-		k = strings.ToLower(k)
-		k = "tag_" + k
-		k = invalidLabelChars.ReplaceAllString(k, "_")
-		labels[k] = v
+		labels[tagLabelName(k)] = v
 	}
 
 	// create a label for each field of the resource
@@ -84,7 +215,7 @@ func CreateAllResourceLabelsFrom(rm resourceMeta) map[string]string {
 	for i := 0; i < val.NumField(); i++ {
 		field := val.Field(i)
 		tag := reflect.TypeOf(rm.resource).Field(i).Tag.Get(formatTag)
-		if field.Kind() == reflect.String {
+		if field.Kind() == reflect.String && tag != "-" {
 			labels[tag] = field.String()
 		}
 	}
@@ -97,9 +228,17 @@ func CreateAllResourceLabelsFrom(rm resourceMeta) map[string]string {
 	for k, v := range resourceLabels {
 		labels[k] = v
 	}
+	if rm.parentResourceName != "" {
+		labels["parent_resource_name"] = rm.parentResourceName
+	}
 	return labels
 }
 
+// tagLabelName returns the label name of an Azure tag.
+func tagLabelName(tag string) string {
+	return invalidLabelChars.ReplaceAllString("tag_"+strings.ToLower(tag), "_")
+}
+
 func hasAggregation(aggregations []string, aggregation string) bool {
 	if len(aggregations) == 0 {
 		return true
@@ -3,6 +3,11 @@ package main
 import (
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/RobustPerception/azure_metrics_exporter/config"
+
+	yaml "gopkg.in/yaml.v2"
 )
 
 func TestCreateResourceLabels(t *testing.T) {
@@ -18,6 +23,18 @@ func TestCreateResourceLabels(t *testing.T) {
 			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-002/providers/Microsoft.Sql/servers/sqlprod/databases/prod-db-01/providers/microsoft.insights/metrics",
 			map[string]string{"resource_group": "prod-rg-002", "resource_name": "sqlprod", "sub_resource_name": "prod-db-01"},
 		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/storage/providers/Microsoft.Storage/storageAccounts/prodstorage/blobServices/default/containers/logs/providers/microsoft.insights/metrics?api-version=2018-01-01",
+			map[string]string{"resource_group": "storage", "resource_name": "prodstorage", "sub_resource_name": "default/logs"},
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/providers/Microsoft.Security/pricings/VirtualMachines/providers/microsoft.insights/metrics",
+			map[string]string{"resource_group": "", "resource_name": "VirtualMachines"},
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/invalid",
+			map[string]string{"resource_group": "", "resource_name": ""},
+		},
 	}
 
 	for _, c := range cases {
@@ -82,6 +99,14 @@ func TestCetResourceType(t *testing.T) {
 			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-002/providers/Microsoft.Sql/servers/sqlprod/databases/prod-db-01/providers/microsoft.insights/metrics",
 			"Microsoft.Sql/servers/databases",
 		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/storage/providers/Microsoft.Storage/storageAccounts/prodstorage/blobServices/default/containers/logs/providers/microsoft.insights/metrics",
+			"Microsoft.Storage/storageAccounts/blobServices/containers",
+		},
+		{
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/invalid",
+			"",
+		},
 	}
 
 	for _, c := range cases {
@@ -92,3 +117,165 @@ func TestCetResourceType(t *testing.T) {
 		}
 	}
 }
+
+func TestResourceIDs(t *testing.T) {
+	sc.C = &config.Config{
+		Credentials: config.Credentials{SubscriptionID: "abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6"},
+	}
+
+	var cases = []struct {
+		id       string
+		full     string
+		relative string
+	}{
+		{
+			"/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+			"/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+			"/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+		},
+		{
+			"/SUBSCRIPTIONS/ABC123D4-E5F6-G7H8-I9J10-A1B2C3D4E5F6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+			"/SUBSCRIPTIONS/ABC123D4-E5F6-G7H8-I9J10-A1B2C3D4E5F6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+			"/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+		},
+		{
+			"/subscriptions/ffffffff-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+			"/subscriptions/ffffffff-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+			"/subscriptions/ffffffff-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01",
+		},
+	}
+
+	for _, c := range cases {
+		if got := fullResourceID(c.id); got != c.full {
+			t.Errorf("doesn't create expected full resource ID\ngot: %v\nwant: %v", got, c.full)
+		}
+		if got := relativeResourceID(c.id); got != c.relative {
+			t.Errorf("doesn't create expected relative resource ID\ngot: %v\nwant: %v", got, c.relative)
+		}
+	}
+}
+
+func TestCreateMetricLabels(t *testing.T) {
+	sc.C = &config.Config{}
+
+	var options config.SelectorOptions
+	err := yaml.Unmarshal([]byte(`
+labels:
+  team: "{{ .Tags.team }}"
+  region: "{{ .Location }}"
+  owner: "{{ .Tags.owner }}"
+  tier: "gold"
+`), &options)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	rm := resourceMeta{
+		resourceURL: "/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-002/providers/Microsoft.Sql/servers/sqlprod/databases/prod-db-01/providers/microsoft.insights/metrics",
+		resource: AzureResource{
+			Location: "canadaeast",
+			Tags:     map[string]string{"team": "payments"},
+		},
+		parentResourceName: "sqlprod",
+		options:            options,
+	}
+
+	got := CreateMetricLabels(rm)
+	want := map[string]string{
+		"resource_group":       "prod-rg-002",
+		"resource_name":        "sqlprod",
+		"sub_resource_name":    "prod-db-01",
+		"parent_resource_name": "sqlprod",
+		"team":                 "payments",
+		"region":               "canadaeast",
+		"owner":                "",
+		"tier":                 "gold",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("doesn't create expected metric labels\ngot: %v\nwant: %v", got, want)
+	}
+}
+
+func TestCreateMetricLabelsTagLabels(t *testing.T) {
+	sc.C = &config.Config{TagLabels: []string{"team", "Cost Center"}}
+	url := "/subscriptions/abc123d4-e5f6-g7h8-i9j10-a1b2c3d4e5f6/resourceGroups/prod-rg-001/providers/Microsoft.Compute/virtualMachines/prod-vm-01/providers/microsoft.insights/metrics"
+
+	var cases = []struct {
+		rm   resourceMeta
+		want map[string]string
+	}{
+		{
+			resourceMeta{
+				resourceURL:   url,
+				resource:      AzureResource{Tags: map[string]string{"Team": "payments", "env": "prod"}},
+				inheritedTags: map[string]string{"team": "platform", "cost center": "42"},
+			},
+			map[string]string{"resource_group": "prod-rg-001", "resource_name": "prod-vm-01", "tag_team": "payments", "tag_cost_center": "42"},
+		},
+		{
+			resourceMeta{
+				resourceURL: url,
+				resource:    AzureResource{Tags: map[string]string{"env": "prod"}},
+				options:     config.SelectorOptions{TagLabels: []string{"env"}},
+			},
+			map[string]string{"resource_group": "prod-rg-001", "resource_name": "prod-vm-01", "tag_env": "prod"},
+		},
+		{
+			resourceMeta{resourceURL: url},
+			map[string]string{"resource_group": "prod-rg-001", "resource_name": "prod-vm-01", "tag_team": "", "tag_cost_center": ""},
+		},
+	}
+
+	for _, c := range cases {
+		got := CreateMetricLabels(c.rm)
+
+		if !reflect.DeepEqual(got, c.want) {
+			t.Errorf("doesn't create expected tag labels\ngot: %v\nwant: %v", got, c.want)
+		}
+	}
+}
+
+func TestMetricNameFrom(t *testing.T) {
+	var cases = []struct {
+		namespace string
+		metric    string
+		unit      string
+		normalize bool
+		want      string
+		scale     float64
+	}{
+		{"", "Percentage CPU", "Percent", false, "percentage_cpu_percent", 1},
+		{"", "Percentage CPU", "Percent", true, "percentage_cpu_ratio", 0.01},
+		{"", "SuccessE2ELatency", "MilliSeconds", true, "successe2elatency_seconds", 0.001},
+		{"", "Network In Total", "Bytes", true, "network_in_total_bytes", 1},
+		{"", "Disk Read Bytes/sec", "BytesPerSecond", true, "disk_read_bytes_per_sec_bytes_per_second", 1},
+		{"", "Transactions", "Count", true, "transactions_count", 1},
+		{"Microsoft.Storage/storageAccounts", "Transactions", "Count", false, "microsoft_storage_storageaccounts_transactions_count", 1},
+	}
+
+	for _, c := range cases {
+		got, scale := metricNameFrom(c.namespace, c.metric, c.unit, c.normalize)
+		if got != c.want || scale != c.scale {
+			t.Errorf("doesn't build metric name for %s in %s\ngot: %v %v\nwant: %v %v", c.metric, c.unit, got, scale, c.want, c.scale)
+		}
+	}
+}
+
+func TestQueryWindow(t *testing.T) {
+	var cases = []struct {
+		config config.Config
+		want   time.Duration
+	}{
+		{config.Config{}, time.Minute},
+		{config.Config{LateData: config.LateData{Enabled: true}}, 5 * time.Minute},
+		{config.Config{LateData: config.LateData{Enabled: true}, TotalCounters: config.TotalCounters{Enabled: true}}, 10 * time.Minute},
+		{config.Config{LateData: config.LateData{Enabled: true, Lookback: 15 * time.Minute}, TotalCounters: config.TotalCounters{Enabled: true}}, 15 * time.Minute},
+	}
+
+	for _, c := range cases {
+		sc.C = &c.config
+		if got := queryWindow(); got != c.want {
+			t.Errorf("doesn't query the expected window\ngot: %v\nwant: %v", got, c.want)
+		}
+	}
+}